@@ -27,16 +27,17 @@ func balancesListCmd() *cobra.Command {
 		Use:   "list",
 		Short: "Lists all balances",
 		Run: func(cmd *cobra.Command, args []string) {
-			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd))
+			state, err := database.NewReadOnlyStateFromDisk(getDataDirFromCmd(cmd))
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
 			}
 			defer state.Close()
-			fmt.Printf("Account balances at %x:\n", state.LatestBlockHash())
+			hash, balances := state.Balances()
+			fmt.Printf("Account balances at %x:\n", hash)
 			fmt.Println("______________________")
 			fmt.Println("")
-			for account, balance := range state.Balances {
+			for account, balance := range balances {
 				fmt.Println(fmt.Sprintf("%s:%d", account, balance))
 			}
 		},
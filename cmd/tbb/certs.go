@@ -0,0 +1,48 @@
+package main
+
+import (
+	"blocks/node"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+const flagHosts = "hosts"
+const flagNames = "names"
+
+func certsCmd() *cobra.Command {
+	var certsCmd = &cobra.Command{
+		Use:   "certs",
+		Short: "TLS certificate helpers (generate ...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+	certsCmd.AddCommand(certsGenerateCmd())
+	return certsCmd
+}
+
+func certsGenerateCmd() *cobra.Command {
+	var certsGenerateCmd = &cobra.Command{
+		Use:   "generate",
+		Short: "Creates a local CA, or reuses the one in --out, and signs a certificate per node name",
+		Run: func(cmd *cobra.Command, args []string) {
+			out, _ := cmd.Flags().GetString(flagOut)
+			hosts, _ := cmd.Flags().GetStringSlice(flagHosts)
+			names, _ := cmd.Flags().GetStringSlice(flagNames)
+			err := node.GenerateCerts(out, names, hosts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Run nodes with --%s %s/<name>.crt --%s %s/<name>.key --%s %s/%s.crt\n", flagTLSCert, out, flagTLSKey, out, flagTLSCA, out, node.CAName)
+		},
+	}
+	certsGenerateCmd.Flags().String(flagOut, "", "directory the CA and certificates are written to")
+	certsGenerateCmd.MarkFlagRequired(flagOut)
+	certsGenerateCmd.Flags().StringSlice(flagHosts, []string{"127.0.0.1", "localhost"}, "IPs and DNS names the nodes are reached at")
+	certsGenerateCmd.Flags().StringSlice(flagNames, []string{"node"}, "names of the certificates to generate, one per node")
+	return certsGenerateCmd
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"blocks/database"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func chainCmd() *cobra.Command {
+	var chainCmd = &cobra.Command{
+		Use:   "chain",
+		Short: "Verifies, exports and imports the local blockchain",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+	chainCmd.AddCommand(chainVerifyCmd())
+	chainCmd.AddCommand(chainExportCmd())
+	chainCmd.AddCommand(chainImportCmd())
+	return chainCmd
+}
+
+func chainVerifyCmd() *cobra.Command {
+	var chainVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Replays block.db from the genesis and checks every block",
+		Run: func(cmd *cobra.Command, args []string) {
+			report, err := database.VerifyChain(getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("%d valid blocks, height %d, latest block %s\n", report.Blocks, report.Height, report.LatestBlockHash.Hex())
+			ok := true
+			if report.BadBlock != nil {
+				ok = false
+				bad := report.BadBlock
+				fmt.Printf("Block #%d (record %d, hash %s) is invalid: %s\n", bad.Number, bad.Index, bad.Hash.Hex(), bad.Reason)
+			}
+
+			expectedStatePath, _ := cmd.Flags().GetString(flagExpectedState)
+			if expectedStatePath != "" {
+				expected, err := database.LoadExpectedState(expectedStatePath)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				diffs := database.DiffBalances(expected.Balances, report.Balances)
+				for _, diff := range diffs {
+					fmt.Printf("Balance of '%s' is %d, expected %d\n", diff.Account, diff.Actual, diff.Expected)
+				}
+				if len(diffs) > 0 {
+					ok = false
+				} else {
+					fmt.Println("Balances match the expected state")
+				}
+			}
+
+			if !ok {
+				os.Exit(1)
+			}
+			fmt.Println("Chain is valid")
+		},
+	}
+	addDefaultRequiredFlags(chainVerifyCmd)
+	chainVerifyCmd.Flags().String(flagExpectedState, "", "JSON file with the expected final balances, like {\"balances\": {...}}")
+	return chainVerifyCmd
+}
+
+func chainExportCmd() *cobra.Command {
+	var chainExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Writes blocks and the genesis into a portable chain archive",
+		Run: func(cmd *cobra.Command, args []string) {
+			from, _ := cmd.Flags().GetUint64(flagFrom)
+			to, _ := cmd.Flags().GetUint64(flagTo)
+			out, _ := cmd.Flags().GetString(flagOut)
+			compress, _ := cmd.Flags().GetBool(flagGzip)
+
+			f, err := os.OpenFile(out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			manifest, err := database.ExportChain(getDataDirFromCmd(cmd), f, from, to, compress)
+			if err == nil {
+				err = f.Close()
+			}
+			if err != nil {
+				f.Close()
+				os.Remove(out)
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Exported %d blocks to %s, sha256 %s\n", manifest.Blocks, out, manifest.Sha256)
+		},
+	}
+	addDefaultRequiredFlags(chainExportCmd)
+	chainExportCmd.Flags().Uint64(flagFrom, 0, "number of the first exported block")
+	chainExportCmd.Flags().Uint64(flagTo, 0, "number of the last exported block, 0 for the latest one")
+	chainExportCmd.Flags().String(flagOut, "", "path of the archive to create")
+	chainExportCmd.Flags().Bool(flagGzip, false, "gzip compress the archive")
+	chainExportCmd.MarkFlagRequired(flagOut)
+	return chainExportCmd
+}
+
+func chainImportCmd() *cobra.Command {
+	var chainImportCmd = &cobra.Command{
+		Use:   "import FILE",
+		Short: "Validates and adds the blocks of a chain archive",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fsyncRaw, _ := cmd.Flags().GetString(flagFsync)
+			fsync, err := database.ParseFsyncPolicy(fsyncRaw)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+
+			report, err := database.ImportChain(getDataDirFromCmd(cmd), f, database.WithFsyncPolicy(fsync))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Imported %d blocks, skipped %d already known, latest block %s\n", report.Added, report.Skipped, report.LatestBlockHash.Hex())
+		},
+	}
+	addDefaultRequiredFlags(chainImportCmd)
+	chainImportCmd.Flags().String(flagFsync, string(database.FsyncAlways), "when imported blocks are flushed to disk: 'always' or 'never'")
+	return chainImportCmd
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"blocks/database"
+	"blocks/node"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const flagConfig = "config"
+const flagBootstrap = "bootstrap"
+const flagBootstrapAccount = "bootstrap-account"
+const flagMiningInterval = "mining-interval"
+const flagSyncInterval = "sync-interval"
+
+// envPrefix starts the environment variables overriding the config file,
+// named after the flags: TBB_PORT for --port, TBB_API_TOKEN for --api-token.
+const envPrefix = "TBB_"
+
+// runConfig holds the settings of `tbb run`. They are resolved from the
+// defaults, then the JSON config file given by --config, then the TBB_*
+// environment variables and finally the flags set on the command line.
+//
+//	{
+//	  "datadir": "/var/lib/tbb",
+//	  "network": {"ip": "10.0.0.2", "port": 8080, "bootstrap": "10.0.0.1:8080", "bootstrap_account": "andrej"},
+//	  "mining": {"miner": "babayaga", "threads": 4, "interval": "10s", "signer_key": "/etc/tbb/signer.key"},
+//	  "sync": {"interval": "45s"},
+//	  "api": {"tokens": ["secret"], "rate_limit": 20, "rate_burst": 40, "tls": {"cert": "", "key": "", "ca": ""}},
+//	  "log": {"level": "info", "format": "json"},
+//	  "storage": {"fsync": "always"}
+//	}
+type runConfig struct {
+	DataDir string        `json:"datadir"`
+	Network networkConfig `json:"network"`
+	Mining  miningConfig  `json:"mining"`
+	Sync    syncConfig    `json:"sync"`
+	API     apiConfig     `json:"api"`
+	Log     logConfig     `json:"log"`
+	Storage storageConfig `json:"storage"`
+}
+
+type networkConfig struct {
+	IP               string `json:"ip"`
+	Port             uint64 `json:"port"`
+	Bootstrap        string `json:"bootstrap"`
+	BootstrapAccount string `json:"bootstrap_account"`
+}
+
+type miningConfig struct {
+	Miner     string   `json:"miner"`
+	Threads   int      `json:"threads"`
+	Interval  duration `json:"interval"`
+	SignerKey string   `json:"signer_key"`
+}
+
+type syncConfig struct {
+	Interval duration `json:"interval"`
+}
+
+type apiConfig struct {
+	Tokens    []string  `json:"tokens"`
+	RateLimit float64   `json:"rate_limit"`
+	RateBurst int       `json:"rate_burst"`
+	TLS       tlsConfig `json:"tls"`
+}
+
+type tlsConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	CA   string `json:"ca"`
+}
+
+type logConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+type storageConfig struct {
+	Fsync string `json:"fsync"`
+}
+
+// duration reads as a Go duration string such as "45s" or "1m30s".
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as \"45s\"", data)
+	}
+	parsed, err := time.ParseDuration(raw)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as \"45s\"", data)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultRunConfig() runConfig {
+	return runConfig{
+		Network: networkConfig{
+			IP:               node.DefaultIP,
+			Port:             node.DefaultHTTPort,
+			Bootstrap:        "127.0.0.1:8080",
+			BootstrapAccount: "andrej",
+		},
+		Mining: miningConfig{
+			Miner:    node.DefaultMiner,
+			Threads:  node.DefaultMiningThreads,
+			Interval: duration(node.DefaultMiningInterval),
+		},
+		Sync: syncConfig{Interval: duration(node.DefaultSyncInterval)},
+		API: apiConfig{
+			RateLimit: node.DefaultRateLimit,
+			RateBurst: node.DefaultRateBurst,
+		},
+		Log:     logConfig{Level: "info", Format: logFormatText},
+		Storage: storageConfig{Fsync: string(database.FsyncAlways)},
+	}
+}
+
+// loadRunConfig resolves the settings of cmd, see runConfig.
+func loadRunConfig(cmd *cobra.Command) (runConfig, error) {
+	cfg := defaultRunConfig()
+
+	path, _ := cmd.Flags().GetString(flagConfig)
+	if path == "" {
+		path = os.Getenv(envName(flagConfig))
+	}
+	if path != "" {
+		err := cfg.readFile(path)
+		if err != nil {
+			return runConfig{}, err
+		}
+	}
+
+	for _, setting := range cfg.settings() {
+		if raw, ok := os.LookupEnv(envName(setting.flag)); ok {
+			err := setting.set(raw)
+			if err != nil {
+				return runConfig{}, fmt.Errorf("invalid %s '%s': %s", envName(setting.flag), raw, err)
+			}
+		}
+		if flag := cmd.Flags().Lookup(setting.flag); flag != nil && flag.Changed {
+			raw := flag.Value.String()
+			if values, err := cmd.Flags().GetStringSlice(setting.flag); err == nil {
+				raw = strings.Join(values, ",")
+			}
+			err := setting.set(raw)
+			if err != nil {
+				return runConfig{}, fmt.Errorf("invalid --%s '%s': %s", setting.flag, raw, err)
+			}
+		}
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (cfg *runConfig) readFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid config file '%s': %s", path, err)
+	}
+	return nil
+}
+
+func envName(flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// setting overrides a field of the config from the string value of an
+// environment variable or a flag.
+type setting struct {
+	flag string
+	set  func(raw string) error
+}
+
+func (cfg *runConfig) settings() []setting {
+	return []setting{
+		{flagDataDir, setString(&cfg.DataDir)},
+		{flagIP, setString(&cfg.Network.IP)},
+		{flagPort, func(raw string) error {
+			port, err := strconv.ParseUint(raw, 10, 64)
+			cfg.Network.Port = port
+			return err
+		}},
+		{flagBootstrap, setString(&cfg.Network.Bootstrap)},
+		{flagBootstrapAccount, setString(&cfg.Network.BootstrapAccount)},
+		{flagMiner, setString(&cfg.Mining.Miner)},
+		{flagMiningThreads, func(raw string) error {
+			threads, err := strconv.Atoi(raw)
+			cfg.Mining.Threads = threads
+			return err
+		}},
+		{flagMiningInterval, setDuration(&cfg.Mining.Interval)},
+		{flagSignerKey, setString(&cfg.Mining.SignerKey)},
+		{flagSyncInterval, setDuration(&cfg.Sync.Interval)},
+		{flagAPIToken, func(raw string) error {
+			cfg.API.Tokens = nil
+			for _, token := range strings.Split(raw, ",") {
+				if token = strings.TrimSpace(token); token != "" {
+					cfg.API.Tokens = append(cfg.API.Tokens, token)
+				}
+			}
+			return nil
+		}},
+		{flagRateLimit, func(raw string) error {
+			rateLimit, err := strconv.ParseFloat(raw, 64)
+			cfg.API.RateLimit = rateLimit
+			return err
+		}},
+		{flagRateBurst, func(raw string) error {
+			burst, err := strconv.Atoi(raw)
+			cfg.API.RateBurst = burst
+			return err
+		}},
+		{flagTLSCert, setString(&cfg.API.TLS.Cert)},
+		{flagTLSKey, setString(&cfg.API.TLS.Key)},
+		{flagTLSCA, setString(&cfg.API.TLS.CA)},
+		{flagLogLevel, setString(&cfg.Log.Level)},
+		{flagLogFormat, setString(&cfg.Log.Format)},
+		{flagFsync, setString(&cfg.Storage.Fsync)},
+	}
+}
+
+func setString(field *string) func(string) error {
+	return func(raw string) error {
+		*field = raw
+		return nil
+	}
+}
+
+func setDuration(field *duration) func(string) error {
+	return func(raw string) error {
+		parsed, err := time.ParseDuration(raw)
+		*field = duration(parsed)
+		return err
+	}
+}
+
+// validate reports every invalid setting at once.
+func (cfg runConfig) validate() error {
+	problems := make([]string, 0)
+	if cfg.DataDir == "" {
+		problems = append(problems, "datadir is required")
+	}
+	if net.ParseIP(cfg.Network.IP) == nil {
+		problems = append(problems, fmt.Sprintf("network.ip '%s' is not an IP address", cfg.Network.IP))
+	}
+	if cfg.Network.Port == 0 || cfg.Network.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("network.port %d is not between 1 and 65535", cfg.Network.Port))
+	}
+	if cfg.Network.Bootstrap != "" {
+		if _, _, err := parseHostPort(cfg.Network.Bootstrap); err != nil {
+			problems = append(problems, fmt.Sprintf("network.bootstrap '%s' is not an ip:port address", cfg.Network.Bootstrap))
+		}
+	}
+	if cfg.Mining.Threads < 1 {
+		problems = append(problems, fmt.Sprintf("mining.threads %d must be at least 1", cfg.Mining.Threads))
+	}
+	if time.Duration(cfg.Mining.Interval) < time.Second {
+		problems = append(problems, fmt.Sprintf("mining.interval %s must be at least 1s", time.Duration(cfg.Mining.Interval)))
+	}
+	if time.Duration(cfg.Sync.Interval) < time.Second {
+		problems = append(problems, fmt.Sprintf("sync.interval %s must be at least 1s", time.Duration(cfg.Sync.Interval)))
+	}
+	if cfg.API.RateLimit < 0 {
+		problems = append(problems, fmt.Sprintf("api.rate_limit %g can't be negative", cfg.API.RateLimit))
+	}
+	if cfg.API.RateBurst < 0 {
+		problems = append(problems, fmt.Sprintf("api.rate_burst %d can't be negative", cfg.API.RateBurst))
+	}
+	tls := cfg.API.TLS
+	if (tls.Cert == "") != (tls.Key == "") {
+		problems = append(problems, "api.tls.cert and api.tls.key must be set together")
+	}
+	if tls.CA != "" && tls.Cert == "" {
+		problems = append(problems, "api.tls.ca requires api.tls.cert and api.tls.key")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level '%s' is not one of debug, info, warn or error", cfg.Log.Level))
+	}
+	if cfg.Log.Format != logFormatText && cfg.Log.Format != logFormatJson {
+		problems = append(problems, fmt.Sprintf("log.format '%s' is not one of text or json", cfg.Log.Format))
+	}
+	if _, err := database.ParseFsyncPolicy(cfg.Storage.Fsync); err != nil {
+		problems = append(problems, fmt.Sprintf("storage.fsync: %s", err))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// bootstrapPeer returns the configured bootstrap peer, or an empty one for
+// the first node of a network.
+func (cfg runConfig) bootstrapPeer() node.PeerNode {
+	if cfg.Network.Bootstrap == "" {
+		return node.PeerNode{}
+	}
+	ip, port, _ := parseHostPort(cfg.Network.Bootstrap)
+	return node.NewPeerNode(ip, port, true, database.NewAccount(cfg.Network.BootstrapAccount), false)
+}
+
+func parseHostPort(address string) (string, uint64, error) {
+	host, portRaw, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portRaw, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
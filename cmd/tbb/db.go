@@ -0,0 +1,71 @@
+package main
+
+import (
+	"blocks/database"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+func dbCmd() *cobra.Command {
+	var dbCmd = &cobra.Command{
+		Use:   "db",
+		Short: "Maintains the blockchain database (repair, migrate ...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+	dbCmd.AddCommand(dbRepairCmd())
+	dbCmd.AddCommand(dbMigrateCmd())
+	return dbCmd
+}
+
+func dbRepairCmd() *cobra.Command {
+	var dbRepairCmd = &cobra.Command{
+		Use:   "repair",
+		Short: "Truncates block.db after its last valid block",
+		Run: func(cmd *cobra.Command, args []string) {
+			report, err := database.RepairBlockDb(getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("%d valid blocks kept\n", report.ValidBlocks)
+			if report.RemovedBytes == 0 {
+				fmt.Println("block.db is healthy, nothing removed")
+				return
+			}
+			fmt.Printf("Removed %d bytes: %s\n", report.RemovedBytes, report.Reason)
+			fmt.Printf("Removed data saved to %s\n", report.BackupPath)
+		},
+	}
+	addDefaultRequiredFlags(dbRepairCmd)
+	return dbRepairCmd
+}
+
+func dbMigrateCmd() *cobra.Command {
+	var dbMigrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrades the data dir to the layout of this version of tbb",
+		Run: func(cmd *cobra.Command, args []string) {
+			report, err := database.MigrateDataDir(getDataDirFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if len(report.Applied) == 0 {
+				fmt.Printf("Data dir is at version %d, nothing to migrate\n", report.ToVersion)
+				return
+			}
+			fmt.Printf("Migrated the data dir from version %d to %d:\n", report.FromVersion, report.ToVersion)
+			for _, step := range report.Applied {
+				fmt.Printf("  - %s\n", step)
+			}
+			fmt.Printf("Previous content saved to %s, remove it once the node runs fine\n", report.BackupDir)
+		},
+	}
+	addDefaultRequiredFlags(dbMigrateCmd)
+	return dbMigrateCmd
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const flagLogLevel = "log-level"
+const flagLogFormat = "log-format"
+
+const (
+	logFormatText = "text"
+	logFormatJson = "json"
+)
+
+func addLogFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().String(flagLogLevel, "info", "minimum level of the logged messages: 'debug', 'info', 'warn' or 'error'")
+	cmd.PersistentFlags().String(flagLogFormat, logFormatText, "format of the logged messages: 'text' or 'json'")
+}
+
+// setupLogger makes the logger described by the log flags the default one,
+// used by everything that isn't handed a logger explicitly.
+func setupLogger(cmd *cobra.Command) error {
+	levelRaw, _ := cmd.Flags().GetString(flagLogLevel)
+	format, _ := cmd.Flags().GetString(flagLogFormat)
+	return configureLogger(levelRaw, format)
+}
+
+func configureLogger(levelRaw string, format string) error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(levelRaw))
+	if err != nil {
+		return fmt.Errorf("unknown log level '%s'", levelRaw)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case logFormatJson:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format '%s'", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
@@ -2,28 +2,53 @@ package main
 
 import (
 	"blocks/fs"
+	"blocks/node"
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 const flagDataDir = "datadir"
 const flagMiner = "miner"
 const flagPort = "port"
 const flagIP = "ip"
+const flagMiningThreads = "mining-threads"
+const flagFsync = "fsync"
+const flagExpectedState = "expected-state"
+const flagFrom = "from"
+const flagTo = "to"
+const flagGzip = "gzip"
+const flagAPIToken = "api-token"
+const flagRateLimit = "rate-limit"
+const flagRateBurst = "rate-burst"
+const flagTLSCert = "tls-cert"
+const flagTLSKey = "tls-key"
+const flagTLSCA = "tls-ca"
 
 func main() {
 	var tbbCmd = &cobra.Command{
 		Use:   "tbb",
 		Short: "The Blockchain Bar CLI",
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return setupLogger(cmd)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 		},
 	}
+	addLogFlags(tbbCmd)
 
 	tbbCmd.AddCommand(versionCmd)
 	tbbCmd.AddCommand(balancesCmd())
 	tbbCmd.AddCommand(runCmd())
-	tbbCmd.AddCommand(migrateCmd())
+	tbbCmd.AddCommand(seedCmd())
+	tbbCmd.AddCommand(minerCmd())
+	tbbCmd.AddCommand(poaCmd())
+	tbbCmd.AddCommand(dbCmd())
+	tbbCmd.AddCommand(chainCmd())
+	tbbCmd.AddCommand(certsCmd())
 
 	err := tbbCmd.Execute()
 	if err != nil {
@@ -41,6 +66,24 @@ func getDataDirFromCmd(cmd *cobra.Command) string {
 
 	return fs.ExpandPath(dataDir)
 }
+func addTLSFlags(cmd *cobra.Command) {
+	cmd.Flags().String(flagTLSCert, "", "path of the PEM certificate presented to peers and clients")
+	cmd.Flags().String(flagTLSKey, "", "path of the PEM key of the TLS certificate")
+	cmd.Flags().String(flagTLSCA, "", "path of the PEM CA trusted for peers, enables mutual TLS")
+}
+func getTLSConfigFromCmd(cmd *cobra.Command) node.TLSConfig {
+	certFile, _ := cmd.Flags().GetString(flagTLSCert)
+	keyFile, _ := cmd.Flags().GetString(flagTLSKey)
+	caFile, _ := cmd.Flags().GetString(flagTLSCA)
+
+	return node.TLSConfig{CertFile: certFile, KeyFile: keyFile, CAFile: caFile}
+}
+
+// signalContext is cancelled on SIGINT or SIGTERM, letting long running
+// commands shut down cleanly.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
 func incorrectUsageErr() error {
 	return fmt.Errorf("incorrect usage")
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"blocks/database"
+	"blocks/node"
+	"fmt"
+	"github.com/spf13/cobra"
+	"log/slog"
+	"os"
+)
+
+const flagNode = "node"
+
+func minerCmd() *cobra.Command {
+	var minerCmd = &cobra.Command{
+		Use:   "miner",
+		Short: "Mines blocks for a remote TBB node using its work API.",
+		Run: func(cmd *cobra.Command, args []string) {
+			nodeURL, _ := cmd.Flags().GetString(flagNode)
+			miner, _ := cmd.Flags().GetString(flagMiner)
+			miningThreads, _ := cmd.Flags().GetInt(flagMiningThreads)
+			apiToken, _ := cmd.Flags().GetString(flagAPIToken)
+			slog.Info("mining for node", "node", nodeURL, "threads", miningThreads)
+			client := node.ClientConfig{APIToken: apiToken, TLS: getTLSConfigFromCmd(cmd)}
+			ctx, stop := signalContext()
+			defer stop()
+			err := node.RunRemoteMiner(ctx, nodeURL, client, database.NewAccount(miner), miningThreads)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		},
+	}
+	minerCmd.Flags().String(flagNode, "", "base URL of the node to mine for, e.g. http://127.0.0.1:8080 or https://127.0.0.1:8080")
+	minerCmd.MarkFlagRequired(flagNode)
+	minerCmd.Flags().String(flagMiner, node.DefaultMiner, "account receiving the block rewards, defaults to the node's miner")
+	minerCmd.Flags().Int(flagMiningThreads, node.DefaultMiningThreads, "number of goroutines searching for a PoW nonce")
+	minerCmd.Flags().String(flagAPIToken, "", "API token of the node, required when the node has API tokens configured")
+	addTLSFlags(minerCmd)
+	return minerCmd
+}
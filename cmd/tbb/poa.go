@@ -0,0 +1,53 @@
+package main
+
+import (
+	"blocks/database"
+	"blocks/fs"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+const flagSignerKey = "signer-key"
+const flagOut = "out"
+
+func poaCmd() *cobra.Command {
+	var poaCmd = &cobra.Command{
+		Use:   "poa",
+		Short: "Proof-of-authority helpers (keygen ...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+		},
+	}
+	poaCmd.AddCommand(poaKeygenCmd())
+	return poaCmd
+}
+
+func poaKeygenCmd() *cobra.Command {
+	var poaKeygenCmd = &cobra.Command{
+		Use:   "keygen",
+		Short: "Generates a signer key and prints its public key for the genesis signer set",
+		Run: func(cmd *cobra.Command, args []string) {
+			out, _ := cmd.Flags().GetString(flagOut)
+			key, err := database.NewSignerKey()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			err = database.WriteSignerKey(fs.ExpandPath(out), key)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Signer key written to %s\n", out)
+			fmt.Printf("Public key: %s\n", hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+		},
+	}
+	poaKeygenCmd.Flags().String(flagOut, "", "path of the file the private signer key is written to")
+	poaKeygenCmd.MarkFlagRequired(flagOut)
+	return poaKeygenCmd
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"blocks/database"
+	"blocks/fs"
 	"blocks/node"
-	"context"
 	"fmt"
 	"github.com/spf13/cobra"
+	"log/slog"
 	"os"
+	"time"
 )
 
 func runCmd() *cobra.Command {
@@ -14,28 +16,69 @@ func runCmd() *cobra.Command {
 		Use:   "run",
 		Short: "Launches the TBB node and its HTTP API .",
 		Run: func(cmd *cobra.Command, args []string) {
-			miner, _ := cmd.Flags().GetString(flagMiner)
-			ip, _ := cmd.Flags().GetString(flagIP)
-			port, _ := cmd.Flags().GetUint64(flagPort)
-			fmt.Println("launching TBB node and its HTTP API ...")
-			bootstrap := node.NewPeerNode(
-				"127.0.0.1",
-				8080,
-				true,
-				database.NewAccount("andrej"),
-				false,
+			cfg, err := loadRunConfig(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			err = configureLogger(cfg.Log.Level, cfg.Log.Format)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			// validate already checked the policy.
+			fsync, _ := database.ParseFsyncPolicy(cfg.Storage.Fsync)
+			slog.Info("launching TBB node and its HTTP API")
+			opts := []node.Option{
+				node.WithMiningThreads(cfg.Mining.Threads),
+				node.WithMiningInterval(time.Duration(cfg.Mining.Interval)),
+				node.WithSyncInterval(time.Duration(cfg.Sync.Interval)),
+				node.WithFsyncPolicy(fsync),
+				node.WithAPITokens(cfg.API.Tokens),
+				node.WithRateLimit(cfg.API.RateLimit, cfg.API.RateBurst),
+				node.WithTLS(node.TLSConfig{CertFile: cfg.API.TLS.Cert, KeyFile: cfg.API.TLS.Key, CAFile: cfg.API.TLS.CA}),
+				node.WithLogger(slog.Default()),
+			}
+			if cfg.Mining.SignerKey != "" {
+				signerKey, err := database.LoadSignerKey(fs.ExpandPath(cfg.Mining.SignerKey))
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+				opts = append(opts, node.WithSignerKey(signerKey))
+			}
+			n := node.New(
+				fs.ExpandPath(cfg.DataDir),
+				cfg.Network.IP,
+				cfg.Network.Port,
+				database.NewAccount(cfg.Mining.Miner),
+				cfg.bootstrapPeer(),
+				opts...,
 			)
-			n := node.New(getDataDirFromCmd(cmd), ip, port, database.NewAccount(miner), bootstrap)
-			err := n.Run(context.Background())
+			ctx, stop := signalContext()
+			defer stop()
+			err = n.Run(ctx)
 			if err != nil {
-				fmt.Println(err)
+				slog.Error("node stopped", "err", err)
 				os.Exit(1)
 			}
 		},
 	}
-	addDefaultRequiredFlags(runCmd)
+	runCmd.Flags().String(flagConfig, "", "path of a JSON config file, its settings are overridden by TBB_* env vars and flags")
+	runCmd.Flags().String(flagDataDir, "", "absolute path of data where db will be stored, required")
 	runCmd.Flags().String(flagMiner, node.DefaultMiner, "miner account of this node to receive block rewards")
 	runCmd.Flags().String(flagIP, node.DefaultIP, "exposed IP for communication with peers")
 	runCmd.Flags().Uint64(flagPort, node.DefaultHTTPort, "exposed http port for communication with peers")
+	runCmd.Flags().String(flagBootstrap, "127.0.0.1:8080", "ip:port of the first peer to sync with, empty for the first node of a network")
+	runCmd.Flags().String(flagBootstrapAccount, "andrej", "account of the bootstrap peer")
+	runCmd.Flags().Int(flagMiningThreads, node.DefaultMiningThreads, "number of goroutines searching for a PoW nonce")
+	runCmd.Flags().Duration(flagMiningInterval, node.DefaultMiningInterval, "how often pending TXs are checked for mining")
+	runCmd.Flags().Duration(flagSyncInterval, node.DefaultSyncInterval, "how often peers are asked for new blocks and peers")
+	runCmd.Flags().String(flagFsync, string(database.FsyncAlways), "when appended blocks are flushed to disk: 'always' or 'never'")
+	runCmd.Flags().String(flagSignerKey, "", "path of the key sealing blocks when the genesis uses poa consensus")
+	runCmd.Flags().StringSlice(flagAPIToken, nil, "token granting access to the admin endpoints, repeatable. The first one is sent to peers. Required unless --ip is a loopback IP")
+	runCmd.Flags().Float64(flagRateLimit, node.DefaultRateLimit, "requests per second allowed per client IP without an API token, or per client IP when no token is configured, 0 to disable")
+	runCmd.Flags().Int(flagRateBurst, node.DefaultRateBurst, "requests a client IP without an API token may burst above the rate limit")
+	addTLSFlags(runCmd)
 	return runCmd
 }
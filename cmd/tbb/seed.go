@@ -0,0 +1,71 @@
+package main
+
+import (
+	"blocks/database"
+	"blocks/node"
+	"context"
+	"github.com/spf13/cobra"
+	"log/slog"
+	"time"
+)
+
+var seedCmd = func() *cobra.Command {
+	var seedCmd = &cobra.Command{
+		Use:   "seed",
+		Short: "Runs a node until it mines a block of sample TXs",
+		Run: func(cmd *cobra.Command, args []string) {
+			miner, _ := cmd.Flags().GetString(flagMiner)
+			ip, _ := cmd.Flags().GetString(flagIP)
+			port, _ := cmd.Flags().GetUint64(flagPort)
+			miningThreads, _ := cmd.Flags().GetInt(flagMiningThreads)
+			peer := node.NewPeerNode(
+				"127.0.0.1",
+				8080,
+				true,
+				database.NewAccount("andrej"),
+				false,
+			)
+			n := node.New(getDataDirFromCmd(cmd), ip, port, database.NewAccount(miner), peer,
+				node.WithMiningThreads(miningThreads),
+				node.WithPendingTXs(
+					database.NewTx("andrej", "andrej", 3, ""),
+					database.NewTx("andrej", "babayaga", 2000, ""),
+					database.NewTx("babayaga", "andrej", 1, ""),
+					database.NewTx("babayaga", "caesar", 1000, ""),
+					database.NewTx("babayaga", "andrej", 50, ""),
+				),
+			)
+
+			ctx, closeNode := context.WithTimeout(context.Background(), time.Minute*15)
+			defer closeNode()
+
+			go func() {
+				ticker := time.NewTicker(time.Second * 10)
+				defer ticker.Stop()
+
+				for {
+					select {
+					case <-ticker.C:
+						if !n.LatestBlockHash().IsEmpty() {
+							closeNode()
+							return
+						}
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+
+			err := n.Run(ctx)
+			if err != nil {
+				slog.Error("node stopped", "err", err)
+			}
+		},
+	}
+	addDefaultRequiredFlags(seedCmd)
+	seedCmd.Flags().String(flagMiner, node.DefaultMiner, "miner account of this node to receive block rewards")
+	seedCmd.Flags().String(flagIP, node.DefaultIP, "exposed IP for communication with peers")
+	seedCmd.Flags().Uint64(flagPort, node.DefaultHTTPort, "exposed HTTP port for communication with peers")
+	seedCmd.Flags().Int(flagMiningThreads, node.DefaultMiningThreads, "number of goroutines searching for a PoW nonce")
+	return seedCmd
+}
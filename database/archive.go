@@ -0,0 +1,313 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+)
+
+// A chain archive moves a ledger between datadirs without syncing. It is a
+// stream of JSON documents, one per line, optionally gzip compressed:
+//
+//	{"format":"tbb-chain-archive","version":1,"genesis":{...},"from":1,"to":120}
+//	{"hash":"...","block":{...}}                        one line per block, oldest first
+//	{"manifest":{"blocks":120,"sha256":"..."}}
+//
+// genesis is the genesis.json of the exported chain. The manifest sha256
+// covers the block lines, newlines included, and guards against truncated
+// or altered archives. Blocks themselves are validated on import like any
+// other block, the archive is never trusted.
+const archiveFormat = "tbb-chain-archive"
+
+const archiveVersion = 1
+
+type archiveHeader struct {
+	Format  string          `json:"format"`
+	Version int             `json:"version"`
+	Genesis json.RawMessage `json:"genesis"`
+	From    uint64          `json:"from"`
+	To      uint64          `json:"to"`
+}
+
+type ArchiveManifest struct {
+	Blocks int    `json:"blocks"`
+	Sha256 string `json:"sha256"`
+}
+
+// archiveRecord is a line following the archive header, either a block or
+// the closing manifest.
+type archiveRecord struct {
+	BlockFS
+	Manifest *ArchiveManifest `json:"manifest,omitempty"`
+}
+
+// ExportChain writes the blocks numbered from to to of dataDir into w. A to
+// of 0 exports up to the latest block. Like NewReadOnlyStateFromDisk it can
+// run next to a node and fails with ErrDataDirOutdated for a data dir that
+// needs migrating.
+func ExportChain(dataDir string, w io.Writer, from uint64, to uint64, compress bool) (ArchiveManifest, error) {
+	f, err := openReadOnlyBlockDb(dataDir)
+	if err != nil {
+		return ArchiveManifest{}, err
+	}
+	defer f.Close()
+
+	genesisJson, err := ioutil.ReadFile(getGenesisJsonFilePath(dataDir))
+	if err != nil {
+		return ArchiveManifest{}, err
+	}
+	var compactGenesis bytes.Buffer
+	err = json.Compact(&compactGenesis, genesisJson)
+	if err != nil {
+		return ArchiveManifest{}, fmt.Errorf("invalid genesis.json: %s", err)
+	}
+
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	buf := bufio.NewWriter(w)
+	err = writeJsonLine(buf, archiveHeader{archiveFormat, archiveVersion, compactGenesis.Bytes(), from, to})
+	if err != nil {
+		return ArchiveManifest{}, err
+	}
+
+	checksum := sha256.New()
+	manifest := ArchiveManifest{}
+	var writeErr error
+	err = scanBlockDb(f, func(blockFs BlockFS) bool {
+		number := blockFs.Value.Header.Number
+		if number < from {
+			return true
+		}
+		if to != 0 && number > to {
+			return false
+		}
+		writeErr = writeJsonLine(io.MultiWriter(buf, checksum), blockFs)
+		manifest.Blocks++
+		return writeErr == nil
+	})
+	if err != nil {
+		return ArchiveManifest{}, err
+	}
+	if writeErr != nil {
+		return ArchiveManifest{}, writeErr
+	}
+
+	manifest.Sha256 = hex.EncodeToString(checksum.Sum(nil))
+	err = writeJsonLine(buf, struct {
+		Manifest ArchiveManifest `json:"manifest"`
+	}{manifest})
+	if err != nil {
+		return ArchiveManifest{}, err
+	}
+	err = buf.Flush()
+	if err != nil {
+		return ArchiveManifest{}, err
+	}
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			return ArchiveManifest{}, err
+		}
+	}
+	return manifest, nil
+}
+
+func writeJsonLine(w io.Writer, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+type ImportReport struct {
+	Added           int
+	Skipped         int
+	LatestBlockHash Hash
+}
+
+// ImportChain adds the blocks of the archive read from r to dataDir through
+// State.AddBlock. Blocks the datadir already has are skipped. An empty
+// datadir adopts the archive genesis, otherwise both genesis files must be
+// identical. If anything fails, including the manifest check at the end,
+// every block added by the import is removed again. Version 0 blocks are
+// rejected like by State.AddBlock, so chains holding them are moved by
+// copying their data dir instead.
+func ImportChain(dataDir string, r io.Reader, opts ...StateOption) (ImportReport, error) {
+	reader, err := openArchive(r)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	header, err := readArchiveHeader(reader)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	err = importGenesis(dataDir, header.Genesis)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	state, err := NewStateFromDisk(dataDir, opts...)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	defer state.Close()
+
+	startHash := state.LatestBlockHash()
+	report, err := importBlocks(state, reader)
+	if err != nil {
+		if report.Added > 0 {
+			if _, rollbackErr := state.RollbackTo(startHash); rollbackErr != nil {
+				return ImportReport{}, fmt.Errorf("%s, and removing the imported blocks failed: %s", err, rollbackErr)
+			}
+		}
+		return ImportReport{}, err
+	}
+	report.LatestBlockHash = state.LatestBlockHash()
+	return report, nil
+}
+
+func openArchive(r io.Reader) (*bufio.Reader, error) {
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReader(gz), nil
+	}
+	return reader, nil
+}
+
+func readArchiveHeader(reader *bufio.Reader) (archiveHeader, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return archiveHeader{}, fmt.Errorf("not a chain archive: %s", err)
+	}
+	var header archiveHeader
+	err = json.Unmarshal(line, &header)
+	if err != nil || header.Format != archiveFormat {
+		return archiveHeader{}, fmt.Errorf("not a chain archive")
+	}
+	if header.Version != archiveVersion {
+		return archiveHeader{}, fmt.Errorf("unsupported chain archive version %d", header.Version)
+	}
+	return header, nil
+}
+
+// importGenesis writes the archive genesis into a datadir without one, or
+// checks it's the same as the existing one.
+func importGenesis(dataDir string, archived json.RawMessage) error {
+	var archivedGenesis interface{}
+	err := json.Unmarshal(archived, &archivedGenesis)
+	if err != nil {
+		return fmt.Errorf("invalid archive genesis: %s", err)
+	}
+
+	path := getGenesisJsonFilePath(dataDir)
+	if !fileExist(path) {
+		err = os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		var indented bytes.Buffer
+		err = json.Indent(&indented, archived, "", "  ")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, append(indented.Bytes(), '\n'), 0644)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var localGenesis interface{}
+	err = json.Unmarshal(content, &localGenesis)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(localGenesis, archivedGenesis) {
+		return fmt.Errorf("the archive belongs to a chain with a different genesis than %s", path)
+	}
+	return nil
+}
+
+func importBlocks(state *State, reader *bufio.Reader) (ImportReport, error) {
+	report := ImportReport{}
+	checksum := sha256.New()
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return report, fmt.Errorf("truncated chain archive, the manifest is missing")
+		}
+		if err != nil {
+			return report, err
+		}
+		var record archiveRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return report, fmt.Errorf("invalid chain archive record: %s", err)
+		}
+		if record.Manifest != nil {
+			return report, checkArchiveManifest(*record.Manifest, report, checksum)
+		}
+
+		checksum.Write(line)
+		err = importBlock(state, record.BlockFS)
+		if err == errBlockKnown {
+			report.Skipped++
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Added++
+	}
+}
+
+var errBlockKnown = errors.New("block already known")
+
+func importBlock(state *State, blockFs BlockFS) error {
+	hash, err := blockFs.Value.Hash()
+	if err != nil {
+		return err
+	}
+	if hash != blockFs.Key {
+		return fmt.Errorf("block %d: archived hash '%s' doesn't match the block hash '%s'", blockFs.Value.Header.Number, blockFs.Key.Hex(), hash.Hex())
+	}
+	if _, ok := state.index.byHash[hash]; ok {
+		return errBlockKnown
+	}
+	_, err = state.AddBlock(blockFs.Value)
+	if err != nil {
+		return fmt.Errorf("block %d: %s", blockFs.Value.Header.Number, err)
+	}
+	return nil
+}
+
+func checkArchiveManifest(manifest ArchiveManifest, report ImportReport, checksum hash.Hash) error {
+	if blocks := report.Added + report.Skipped; blocks != manifest.Blocks {
+		return fmt.Errorf("chain archive has %d blocks, its manifest lists %d", blocks, manifest.Blocks)
+	}
+	if sum := hex.EncodeToString(checksum.Sum(nil)); sum != manifest.Sha256 {
+		return fmt.Errorf("chain archive checksum is '%s', its manifest lists '%s'", sum, manifest.Sha256)
+	}
+	return nil
+}
@@ -8,8 +8,13 @@ import (
 	"fmt"
 )
 
+// BlockReward is the reward of chains without a genesis monetary policy.
 const BlockReward = 100
 
+// BlockHashTargetPrefix is the hex prefix a valid PoW block hash starts with.
+// IsBlockHashValid additionally requires the following byte to be non-zero.
+const BlockHashTargetPrefix = "000000"
+
 type Hash [32]byte
 
 func (h Hash) MarshalText() ([]byte, error) {
@@ -34,11 +39,20 @@ type Block struct {
 }
 
 type BlockHeader struct {
-	Parent Hash    `json:"parent"`
+	// Version selects how the block is hashed, see BlockEncodingVersion and
+	// BlockTxRootVersion.
+	Version uint8 `json:"version,omitempty"`
+	Parent  Hash  `json:"parent"`
+	// TxRoot commits the header to the block's TXs, see TxRoot. It is only
+	// set from BlockTxRootVersion on.
+	TxRoot Hash    `json:"tx_root"`
 	Number uint64  `json:"number"`
 	Nonce  uint32  `json:"nonce"`
 	Time   uint64  `json:"time"`
 	Miner  Account `json:"miner"`
+	// Signature seals the block in proof-of-authority mode. It stays empty,
+	// and out of the block JSON, for proof-of-work blocks.
+	Signature []byte `json:"signature,omitempty"`
 }
 
 type BlockFS struct {
@@ -47,17 +61,81 @@ type BlockFS struct {
 }
 
 func NewBlock(parent Hash, number uint64, nonce uint32, time uint64, miner Account, txs []Tx) Block {
-	return Block{BlockHeader{parent, number, nonce, time, miner}, txs}
+	return Block{BlockHeader{BlockTxRootVersion, parent, TxRoot(txs), number, nonce, time, miner, nil}, txs}
 }
 
 func (b Block) Hash() (Hash, error) {
-	blockJson, err := json.Marshal(b)
+	if hash, ok := HeaderHash(b.Header); ok {
+		return hash, nil
+	}
+	if b.Header.Version >= BlockEncodingVersion {
+		return sha256.Sum256(EncodeBlock(b)), nil
+	}
+	blockJson, err := json.Marshal(newJsonBlock(b))
 	if err != nil {
 		return Hash{}, err
 	}
 	return sha256.Sum256(blockJson), nil
 }
 
+// HeaderHash returns the hash of the block with the given header, and false
+// for blocks older than BlockTxRootVersion whose hash covers their TXs too.
+func HeaderHash(h BlockHeader) (Hash, bool) {
+	if h.Version < BlockTxRootVersion {
+		return Hash{}, false
+	}
+	return sha256.Sum256(EncodeBlockHeader(h)), true
+}
+
+// TxRoot is the hash of txs encoded as in EncodeBlock.
+func TxRoot(txs []Tx) Hash {
+	e := encoder{}
+	e.txs(txs)
+	return sha256.Sum256(e.buf)
+}
+
+// verifyTxRoot checks that the header of b commits to its TXs. Blocks older
+// than BlockTxRootVersion must not carry a TX root.
+func verifyTxRoot(b Block) error {
+	root := Hash{}
+	if b.Header.Version >= BlockTxRootVersion {
+		root = TxRoot(b.Txs)
+	}
+	if b.Header.TxRoot != root {
+		return fmt.Errorf("block %d TX root must be '%x' not '%x'", b.Header.Number, root, b.Header.TxRoot)
+	}
+	return nil
+}
+
+// jsonBlock is the JSON version 0 blocks are hashed as. It predates TxRoot,
+// which must stay out of it for their hashes not to change.
+type jsonBlock struct {
+	Header jsonBlockHeader `json:"header"`
+	Txs    []Tx            `json:"payload"`
+}
+
+type jsonBlockHeader struct {
+	Version   uint8   `json:"version,omitempty"`
+	Parent    Hash    `json:"parent"`
+	Number    uint64  `json:"number"`
+	Nonce     uint32  `json:"nonce"`
+	Time      uint64  `json:"time"`
+	Miner     Account `json:"miner"`
+	Signature []byte  `json:"signature,omitempty"`
+}
+
+func newJsonBlock(b Block) jsonBlock {
+	h := b.Header
+	return jsonBlock{jsonBlockHeader{h.Version, h.Parent, h.Number, h.Nonce, h.Time, h.Miner, h.Signature}, b.Txs}
+}
+
+// SealHash is the hash of the block without its signature, i.e. the
+// message a proof-of-authority signer signs.
+func (b Block) SealHash() (Hash, error) {
+	b.Header.Signature = nil
+	return b.Hash()
+}
+
 func IsBlockHashValid(hash Hash) bool {
 	return fmt.Sprintf("%x", hash[0]) == "0" &&
 		fmt.Sprintf("%x", hash[1]) == "0" &&
@@ -0,0 +1,400 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// ErrCorruptBlockDb is returned when a record in the middle of block.db
+// can't be decoded. Unlike a torn trailing record it can't be the result of
+// an interrupted append and needs `tbb db repair`.
+var ErrCorruptBlockDb = errors.New("corrupt block.db")
+
+// errTornRecord is returned by blockRecordReader.Next when the last record of
+// block.db is incomplete, typically after a crash in the middle of an append.
+var errTornRecord = errors.New("torn trailing record")
+
+type FsyncPolicy string
+
+// FsyncAlways flushes block.db to stable storage after every appended block.
+const FsyncAlways FsyncPolicy = "always"
+
+// FsyncNever leaves flushing to the OS. Faster, but a power cut can lose
+// the most recent blocks.
+const FsyncNever FsyncPolicy = "never"
+
+func ParseFsyncPolicy(value string) (FsyncPolicy, error) {
+	switch FsyncPolicy(value) {
+	case FsyncAlways, FsyncNever:
+		return FsyncPolicy(value), nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy '%s', expected '%s' or '%s'", value, FsyncAlways, FsyncNever)
+	}
+}
+
+// block.db starts with blockDbMagic followed by records of
+//
+//	length(uvarint) crc32(4, big endian) payload(length)
+//
+// where payload is the 32 bytes block hash followed by EncodeBlock and the
+// checksum covers the payload. Before the binary format block.db held one
+// BlockFS JSON document per line, see migrateJsonBlockDb.
+var blockDbMagic = []byte("TBBBLKDB\x01")
+
+// maxBlockRecordSize bounds the length prefix so a corrupt one can't make
+// the reader allocate arbitrary amounts of memory.
+const maxBlockRecordSize = 64 << 20
+
+// blockRecordReader reads the records of block.db and keeps track of the
+// offset right after the last complete record.
+type blockRecordReader struct {
+	reader *bufio.Reader
+	offset int64
+	empty  bool
+}
+
+// newBlockRecordReader checks the block.db header. A file without any byte
+// is read as an empty block.db.
+func newBlockRecordReader(r io.Reader) (*blockRecordReader, error) {
+	br := &blockRecordReader{reader: bufio.NewReader(r)}
+	magic := make([]byte, len(blockDbMagic))
+	n, err := io.ReadFull(br.reader, magic)
+	if n == 0 && err == io.EOF {
+		br.empty = true
+		return br, nil
+	}
+	if err != nil || !bytes.Equal(magic, blockDbMagic) {
+		return nil, fmt.Errorf("%w: missing binary block.db header", ErrCorruptBlockDb)
+	}
+	br.offset = int64(len(blockDbMagic))
+	return br, nil
+}
+
+// Next returns the next record, io.EOF after the last one, errTornRecord
+// when the last record is incomplete and ErrCorruptBlockDb when a record
+// followed by more data can't be decoded.
+func (br *blockRecordReader) Next() (BlockFS, error) {
+	if br.empty {
+		return BlockFS{}, io.EOF
+	}
+	length, err := binary.ReadUvarint(br.reader)
+	if err == io.EOF {
+		return BlockFS{}, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return BlockFS{}, errTornRecord
+	}
+	if err != nil || length < uint64(len(Hash{})) || length > maxBlockRecordSize {
+		return BlockFS{}, br.corrupt(fmt.Errorf("invalid record length"))
+	}
+
+	record := make([]byte, 4+length)
+	_, err = io.ReadFull(br.reader, record)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return BlockFS{}, errTornRecord
+	}
+	if err != nil {
+		return BlockFS{}, err
+	}
+
+	payload := record[4:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(record[:4]) {
+		if _, peekErr := br.reader.Peek(1); peekErr == io.EOF {
+			return BlockFS{}, errTornRecord
+		}
+		return BlockFS{}, br.corrupt(fmt.Errorf("checksum mismatch"))
+	}
+	block, err := DecodeBlock(payload[len(Hash{}):])
+	if err != nil {
+		return BlockFS{}, br.corrupt(err)
+	}
+
+	blockFs := BlockFS{Value: block}
+	copy(blockFs.Key[:], payload)
+	br.offset += int64(uvarintSize(length)) + int64(len(record))
+	return blockFs, nil
+}
+
+func (br *blockRecordReader) corrupt(err error) error {
+	return fmt.Errorf("%w: undecodable record at offset %d: %s", ErrCorruptBlockDb, br.offset, err)
+}
+
+// Offset is the position in block.db right after the last record returned by Next.
+func (br *blockRecordReader) Offset() int64 {
+	return br.offset
+}
+
+func encodeBlockRecord(blockFs BlockFS) []byte {
+	payload := append(blockFs.Key[:], EncodeBlock(blockFs.Value)...)
+	var header [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(header[:], uint64(len(payload)))
+	binary.BigEndian.PutUint32(header[n:], crc32.ChecksumIEEE(payload))
+	return append(header[:n+4], payload...)
+}
+
+func uvarintSize(v uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], v)
+}
+
+// appendBlockRecord writes the record in a single append and flushes it
+// according to policy. A failed write is truncated away so block.db never
+// keeps a partial record of a running node. It returns the offset of the
+// new record.
+func appendBlockRecord(f *os.File, blockFs BlockFS, policy FsyncPolicy) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = f.Write(encodeBlockRecord(blockFs))
+	if err != nil {
+		if truncErr := f.Truncate(info.Size()); truncErr != nil {
+			return 0, fmt.Errorf("%s, and truncating the partial record failed: %s", err, truncErr)
+		}
+		return 0, err
+	}
+	if policy == FsyncNever {
+		return info.Size(), nil
+	}
+	return info.Size(), f.Sync()
+}
+
+// initBlockDb writes the header of a new, empty block.db.
+func initBlockDb(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > 0 {
+		return nil
+	}
+	_, err = f.Write(blockDbMagic)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// jsonBlockRecordReader reads the newline separated BlockFS JSON documents
+// of a block.db written before the binary format.
+type jsonBlockRecordReader struct {
+	reader *bufio.Reader
+}
+
+func newJsonBlockRecordReader(r io.Reader) *jsonBlockRecordReader {
+	return &jsonBlockRecordReader{bufio.NewReader(r)}
+}
+
+// Next returns the next record, io.EOF after the last one and errTornRecord
+// when the last line is incomplete.
+func (jr *jsonBlockRecordReader) Next() (BlockFS, error) {
+	line, err := jr.reader.ReadBytes('\n')
+	if err == io.EOF {
+		if len(bytes.TrimSpace(line)) == 0 {
+			return BlockFS{}, io.EOF
+		}
+		return BlockFS{}, errTornRecord
+	}
+	if err != nil {
+		return BlockFS{}, err
+	}
+	if len(bytes.TrimSpace(line)) == 0 {
+		return jr.Next()
+	}
+
+	var blockFs BlockFS
+	err = json.Unmarshal(line, &blockFs)
+	if err != nil {
+		if _, peekErr := jr.reader.Peek(1); peekErr == io.EOF {
+			return BlockFS{}, errTornRecord
+		}
+		return BlockFS{}, fmt.Errorf("%w: %s", ErrCorruptBlockDb, err)
+	}
+	return blockFs, nil
+}
+
+// migrateJsonBlockDb converts a JSON lines block.db into the binary format.
+// Blocks keep their version and therefore their hash. It's the first data
+// dir migration and must only run as such, see migrations: it replaces
+// block.db and drops a torn trailing line, backupDir then holding the only
+// copy of both.
+func migrateJsonBlockDb(path string, backupDir string) error {
+	if backupDir == "" {
+		return fmt.Errorf("converting '%s' requires a backup of the database dir", path)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(blockDbMagic))
+	n, err := io.ReadFull(f, magic)
+	if n == 0 || bytes.Equal(magic, blockDbMagic) {
+		return nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	_, err = w.Write(blockDbMagic)
+	if err != nil {
+		return err
+	}
+	reader := newJsonBlockRecordReader(f)
+	count := 0
+	for {
+		blockFs, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == errTornRecord {
+			slog.Warn("dropped an incomplete record at the end of the JSON block.db", "blocks", count, "backup", backupDir)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("converting block.db to the binary format failed: %w", err)
+		}
+		_, err = w.Write(encodeBlockRecord(blockFs))
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	slog.Info("converted block.db to the binary format", "blocks", count)
+	return nil
+}
+
+// RepairReport describes what RepairBlockDb removed from block.db.
+type RepairReport struct {
+	ValidBlocks  int
+	RemovedBytes int64
+	BackupPath   string
+	Reason       string
+}
+
+// RepairBlockDb keeps the longest prefix of block.db made of decodable and
+// valid blocks and truncates the rest. The removed bytes are saved next to
+// block.db for inspection.
+func RepairBlockDb(dataDir string) (RepairReport, error) {
+	state, err := newGenesisState(dataDir, FsyncAlways)
+	if err != nil {
+		return RepairReport{}, err
+	}
+	defer state.Close()
+
+	report := RepairReport{}
+	_, err = state.dbFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return RepairReport{}, err
+	}
+	reader, err := newBlockRecordReader(state.dbFile)
+	if err != nil {
+		return RepairReport{}, err
+	}
+	// offset is where the record being checked starts, block.db is cut there
+	// whether the record can't be decoded or its block is invalid.
+	var offset int64
+	for {
+		offset = reader.Offset()
+		blockFs, err := reader.Next()
+		if err == io.EOF {
+			return report, nil
+		}
+		if err != nil {
+			report.Reason = err.Error()
+			break
+		}
+		err = applyBlock(blockFs.Value, state)
+		if err == nil {
+			var hash Hash
+			hash, err = blockFs.Value.Hash()
+			if err == nil && hash != blockFs.Key {
+				err = fmt.Errorf("stored hash '%s' doesn't match block hash '%s'", blockFs.Key.Hex(), hash.Hex())
+			}
+		}
+		if err != nil {
+			report.Reason = fmt.Sprintf("block %d: %s", blockFs.Value.Header.Number, err)
+			break
+		}
+		state.latestBlock = blockFs.Value
+		state.latestBlockHash = blockFs.Key
+		state.hasGenesisBlock = true
+		report.ValidBlocks++
+	}
+
+	report.BackupPath, report.RemovedBytes, err = cutBlockDb(state.dbFile, offset)
+	return report, err
+}
+
+// cutBlockDb copies everything after offset into a backup file and then
+// truncates block.db at offset.
+func cutBlockDb(f *os.File, offset int64) (string, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	removed := info.Size() - offset
+	if removed <= 0 {
+		return "", 0, nil
+	}
+
+	backupPath := fmt.Sprintf("%s.%d.removed", f.Name(), offset)
+	backup, err := os.OpenFile(backupPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = io.Copy(backup, io.NewSectionReader(f, offset, removed))
+	if err != nil {
+		backup.Close()
+		return "", 0, err
+	}
+	err = backup.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	err = f.Truncate(offset)
+	if err != nil {
+		return "", 0, err
+	}
+	return backupPath, removed, f.Sync()
+}
@@ -0,0 +1,327 @@
+package database
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDataDir creates a data dir whose genesis uses proof-of-authority
+// with andrej as the only signer, so blocks can be sealed without mining.
+func newTestDataDir(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	key, err := NewSignerKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataDir := t.TempDir()
+	err = os.MkdirAll(getDatabaseDirPath(dataDir), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisJson := fmt.Sprintf(`{
+  "balances": {"andrej": 1000},
+  "consensus": {"engine": "poa", "signers": [{"account": "andrej", "public_key": "%s"}]}
+}`, hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+	err = os.WriteFile(getGenesisJsonFilePath(dataDir), []byte(genesisJson), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeDataDirVersion(dataDir, LatestDataDirVersion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dataDir, key
+}
+
+// nextTestBlock seals the block following the tip of state, sending 1 TBB
+// from andrej to babayaga.
+func nextTestBlock(t *testing.T, state *State, key ed25519.PrivateKey) Block {
+	t.Helper()
+	number := state.LatestBlock().Header.Number + 1
+	time := state.LatestBlock().Header.Time + 1
+	tx := NewTx("andrej", "babayaga", 1, fmt.Sprintf("block %d", number))
+	coinbase := NewCoinbaseTx("andrej", state.NextBlockReward(), time)
+	b := NewBlock(state.LatestBlockHash(), number, 0, time, "andrej", []Tx{coinbase, tx})
+	b, err := SignBlock(b, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeTestChain stores count blocks in a new data dir and returns their
+// hashes and the offsets of their records in block.db.
+func writeTestChain(t *testing.T, count int) (string, ed25519.PrivateKey, []Hash, []int64) {
+	t.Helper()
+	dataDir, key := newTestDataDir(t)
+	state, err := NewStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	hashes := make([]Hash, 0, count)
+	for i := 0; i < count; i++ {
+		hash, err := state.AddBlock(nextTestBlock(t, state, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	offsets := append([]int64(nil), state.index.offsets...)
+	return dataDir, key, hashes, offsets
+}
+
+func TestTornRecordIsTruncatedOnLoad(t *testing.T) {
+	dataDir, key, hashes, _ := writeTestChain(t, 3)
+	dbPath := getBlocksDbFilePath(dataDir)
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validSize := info.Size()
+
+	// Append the first half of a fourth record, as a crash in the middle of
+	// AddBlock would.
+	state, err := NewStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := nextTestBlock(t, state, key)
+	state.Close()
+	nextHash, err := next.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := encodeBlockRecord(BlockFS{nextHash, next})
+	partial := record[:len(record)/2]
+	f, err := os.OpenFile(dbPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(partial)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = NewStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatalf("reopening with a torn record failed: %s", err)
+	}
+	defer state.Close()
+
+	if state.LatestBlockHash() != hashes[len(hashes)-1] {
+		t.Errorf("latest block must be '%s' not '%s'", hashes[len(hashes)-1].Hex(), state.LatestBlockHash().Hex())
+	}
+	for i, hash := range hashes {
+		_, err := state.BlockByHash(hash)
+		if err != nil {
+			t.Errorf("block %d didn't survive the truncation: %s", i+1, err)
+		}
+	}
+	info, err = os.Stat(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != validSize {
+		t.Errorf("block.db must be truncated to %d bytes, it is %d", validSize, info.Size())
+	}
+	backup, err := os.ReadFile(fmt.Sprintf("%s.%d.removed", dbPath, validSize))
+	if err != nil {
+		t.Fatalf("the torn record wasn't backed up: %s", err)
+	}
+	if !bytes.Equal(backup, partial) {
+		t.Errorf("backup must hold the %d bytes of the torn record, got %d bytes", len(partial), len(backup))
+	}
+
+	// The repaired block.db takes new blocks again.
+	_, err = state.AddBlock(nextTestBlock(t, state, key))
+	if err != nil {
+		t.Errorf("adding a block after the truncation failed: %s", err)
+	}
+}
+
+func TestRepairBlockDbCutsCorruptMiddleRecord(t *testing.T) {
+	dataDir, _, hashes, offsets := writeTestChain(t, 3)
+	dbPath := getBlocksDbFilePath(dataDir)
+
+	// Flip the last byte of the second record, its checksum no longer
+	// matches while a complete record follows it.
+	content, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[offsets[2]-1] ^= 0xff
+	err = os.WriteFile(dbPath, content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewStateFromDisk(dataDir)
+	if !errors.Is(err, ErrCorruptBlockDb) {
+		t.Fatalf("loading a corrupt block.db must fail with ErrCorruptBlockDb, got: %v", err)
+	}
+
+	report, err := RepairBlockDb(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ValidBlocks != 1 {
+		t.Errorf("repair must keep 1 valid block, kept %d", report.ValidBlocks)
+	}
+	if report.RemovedBytes != int64(len(content))-offsets[1] {
+		t.Errorf("repair must remove %d bytes, removed %d", int64(len(content))-offsets[1], report.RemovedBytes)
+	}
+	if report.BackupPath != filepath.Join(getDatabaseDirPath(dataDir), fmt.Sprintf("block.db.%d.removed", offsets[1])) {
+		t.Errorf("unexpected backup path '%s'", report.BackupPath)
+	}
+	backup, err := os.ReadFile(report.BackupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(backup, content[offsets[1]:]) {
+		t.Errorf("backup must hold the removed records")
+	}
+
+	state, err := NewStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatalf("reopening the repaired block.db failed: %s", err)
+	}
+	defer state.Close()
+	if state.LatestBlockHash() != hashes[0] {
+		t.Errorf("latest block must be '%s' not '%s'", hashes[0].Hex(), state.LatestBlockHash().Hex())
+	}
+	if state.Balance("babayaga") != 1 {
+		t.Errorf("babayaga balance must be 1 not %d", state.Balance("babayaga"))
+	}
+}
+
+func TestReadersRunConcurrentlyWithRollbacks(t *testing.T) {
+	dataDir, key, hashes, _ := writeTestChain(t, 3)
+	state, err := NewStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	done := make(chan struct{})
+	readersDone := make(chan struct{})
+	go func() {
+		defer close(readersDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			tip := state.LatestBlock()
+			_, _ = state.BlockByNumber(tip.Header.Number)
+			_, _ = state.BlocksFrom(0, 10)
+			state.CommonAncestor(state.BlockLocator())
+			state.NextBlockReward()
+			state.Balance("babayaga")
+			state.Balances()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		_, err := state.RollbackTo(hashes[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = state.AddBlock(nextTestBlock(t, state, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	<-readersDone
+
+	if state.LatestBlock().Header.Number != 2 {
+		t.Errorf("latest block must be #2, it is #%d", state.LatestBlock().Header.Number)
+	}
+}
+
+func TestRepairBlockDbCutsBeforeInvalidBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(next Block) BlockFS
+	}{
+		{"wrong parent", func(next Block) BlockFS {
+			next.Header.Parent = Hash{1}
+			hash, _ := next.Hash()
+			return BlockFS{hash, next}
+		}},
+		{"mismatched stored hash", func(next Block) BlockFS {
+			return BlockFS{Hash{1}, next}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataDir, key, hashes, _ := writeTestChain(t, 2)
+			dbPath := getBlocksDbFilePath(dataDir)
+			info, err := os.Stat(dbPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			validSize := info.Size()
+
+			// Append a record with a valid checksum whose block breaks the
+			// rules, followed by the valid next block.
+			state, err := NewStateFromDisk(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := nextTestBlock(t, state, key)
+			state.Close()
+			nextHash, err := next.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := append(encodeBlockRecord(test.record(next)), encodeBlockRecord(BlockFS{nextHash, next})...)
+			f, err := os.OpenFile(dbPath, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write(content)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report, err := RepairBlockDb(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.ValidBlocks != 2 {
+				t.Errorf("repair must keep 2 valid blocks, kept %d", report.ValidBlocks)
+			}
+			if report.RemovedBytes != int64(len(content)) {
+				t.Errorf("repair must remove %d bytes, removed %d", len(content), report.RemovedBytes)
+			}
+
+			state, err = NewStateFromDisk(dataDir)
+			if err != nil {
+				t.Fatalf("reopening the repaired block.db failed: %s", err)
+			}
+			defer state.Close()
+			if state.LatestBlockHash() != hashes[1] {
+				t.Errorf("latest block must be '%s' not '%s'", hashes[1].Hex(), state.LatestBlockHash().Hex())
+			}
+			info, err = os.Stat(dbPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != validSize {
+				t.Errorf("block.db must be truncated to %d bytes, it is %d", validSize, info.Size())
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package database
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// blockIndex maps the blocks of the local chain to their record in block.db
+// so a single block can be read without scanning the file. It's rebuilt
+// every time block.db is loaded and grows with every appended block.
+type blockIndex struct {
+	hashes   []Hash
+	offsets  []int64
+	byHash   map[Hash]int
+	byTxHash map[Hash]int
+	// byAccount lists, in chain order, the blocks with TXs from or to an
+	// account.
+	byAccount   map[Account][]int
+	firstNumber uint64
+}
+
+func newBlockIndex() blockIndex {
+	return blockIndex{byHash: make(map[Hash]int), byTxHash: make(map[Hash]int), byAccount: make(map[Account][]int)}
+}
+
+func (i *blockIndex) add(hash Hash, b Block, offset int64) error {
+	if len(i.hashes) == 0 {
+		i.firstNumber = b.Header.Number
+	}
+	position := len(i.hashes)
+	for _, tx := range b.Txs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			return err
+		}
+		i.byTxHash[txHash] = position
+		i.addAccount(tx.From, position)
+		i.addAccount(tx.To, position)
+	}
+	i.byHash[hash] = position
+	i.hashes = append(i.hashes, hash)
+	i.offsets = append(i.offsets, offset)
+	return nil
+}
+
+func (i *blockIndex) addAccount(account Account, position int) {
+	positions := i.byAccount[account]
+	if account == "" || (len(positions) > 0 && positions[len(positions)-1] == position) {
+		return
+	}
+	i.byAccount[account] = append(positions, position)
+}
+
+// position returns where the block numbered number sits in the chain.
+func (i *blockIndex) position(number uint64) (int, bool) {
+	if len(i.hashes) == 0 || number < i.firstNumber || number-i.firstNumber >= uint64(len(i.hashes)) {
+		return 0, false
+	}
+	return int(number - i.firstNumber), true
+}
+
+// BlockByNumber reads the block numbered number of the local chain.
+func (s *State) BlockByNumber(number uint64) (BlockFS, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	position, ok := s.index.position(number)
+	if !ok {
+		return BlockFS{}, fmt.Errorf("%w: number %d", ErrBlockNotFound, number)
+	}
+	return readBlockRecord(s.dbFile, s.index.offsets[position])
+}
+
+// BlockByHash reads the block of the local chain with the given hash.
+func (s *State) BlockByHash(hash Hash) (BlockFS, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	position, ok := s.index.byHash[hash]
+	if !ok {
+		return BlockFS{}, fmt.Errorf("%w: '%s'", ErrBlockNotFound, hash.Hex())
+	}
+	return readBlockRecord(s.dbFile, s.index.offsets[position])
+}
+
+// TxByHash finds a TX of the local chain and the block including it.
+func (s *State) TxByHash(hash Hash) (Tx, BlockFS, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	position, ok := s.index.byTxHash[hash]
+	if !ok {
+		return Tx{}, BlockFS{}, fmt.Errorf("%w: '%s'", ErrTxNotFound, hash.Hex())
+	}
+	blockFs, err := readBlockRecord(s.dbFile, s.index.offsets[position])
+	if err != nil {
+		return Tx{}, BlockFS{}, err
+	}
+	for _, tx := range blockFs.Value.Txs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			return Tx{}, BlockFS{}, err
+		}
+		if txHash == hash {
+			return tx, blockFs, nil
+		}
+	}
+	return Tx{}, BlockFS{}, fmt.Errorf("%w: '%s'", ErrTxNotFound, hash.Hex())
+}
+
+// BlocksFrom reads up to limit consecutive blocks starting with the one
+// numbered from. It returns fewer blocks, possibly none, past the tip.
+func (s *State) BlocksFrom(from uint64, limit int) ([]BlockFS, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blocks := make([]BlockFS, 0)
+	position, ok := s.index.position(from)
+	if !ok {
+		return blocks, nil
+	}
+	for ; position < len(s.index.offsets) && len(blocks) < limit; position++ {
+		blockFs, err := readBlockRecord(s.dbFile, s.index.offsets[position])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, blockFs)
+	}
+	return blocks, nil
+}
+
+// readBlockRecord reads the record starting at offset of the block.db file
+// f. It reads with ReadAt and leaves the append position of f untouched.
+func readBlockRecord(f *os.File, offset int64) (BlockFS, error) {
+	br := &blockRecordReader{
+		reader: bufio.NewReader(io.NewSectionReader(f, offset, maxBlockRecordSize+binary.MaxVarintLen64+4)),
+		offset: offset,
+	}
+	return br.Next()
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const ConsensusPoW = "pow"
+const ConsensusPoA = "poa"
+
+// ConsensusEngine decides whether a block was sealed according to the rules
+// of the chain. The engine is selected by the genesis file.
+type ConsensusEngine interface {
+	Name() string
+	// VerifyHeader is a cheap pre-check of a header and its claimed hash,
+	// used before the block body is known. The hash is recomputed from the
+	// header from BlockTxRootVersion on, older headers can't be tied to
+	// their hash without the body. parent is the zero BlockHeader when
+	// header belongs to the first block of the chain.
+	VerifyHeader(parent BlockHeader, header BlockHeader, hash Hash) error
+	// VerifySeal checks b on top of parent. parent is the zero Block when b
+	// is the first block of the chain.
+	VerifySeal(parent Block, b Block) error
+}
+
+// ConsensusConfig is the "consensus" section of genesis.json.
+type ConsensusConfig struct {
+	Engine  string   `json:"engine"`
+	Period  uint64   `json:"period"`
+	Signers []Signer `json:"signers"`
+}
+
+// Signer is an account allowed to produce blocks in proof-of-authority mode,
+// identified by its hex encoded ed25519 public key.
+type Signer struct {
+	Account   Account `json:"account"`
+	PublicKey string  `json:"public_key"`
+}
+
+func NewConsensusEngine(cfg ConsensusConfig) (ConsensusEngine, error) {
+	switch cfg.Engine {
+	case "", ConsensusPoW:
+		return PoW{}, nil
+	case ConsensusPoA:
+		return NewPoA(cfg.Period, cfg.Signers)
+	default:
+		return nil, fmt.Errorf("unknown consensus engine '%s'", cfg.Engine)
+	}
+}
+
+// PoW is the proof-of-work engine: the block hash must satisfy IsBlockHashValid.
+type PoW struct{}
+
+func (PoW) Name() string {
+	return ConsensusPoW
+}
+
+func (PoW) VerifyHeader(parent BlockHeader, header BlockHeader, hash Hash) error {
+	err := verifyHeaderHash(header, hash)
+	if err != nil {
+		return err
+	}
+	if !IsBlockHashValid(hash) {
+		return fmt.Errorf("Invalid block hash  %x", hash)
+	}
+	return nil
+}
+
+func (PoW) VerifySeal(parent Block, b Block) error {
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+	if !IsBlockHashValid(hash) {
+		return fmt.Errorf("Invalid block hash  %x", hash)
+	}
+	return nil
+}
+
+// verifyHeaderHash checks hash against the header when the header commits
+// to its block, see HeaderHash.
+func verifyHeaderHash(header BlockHeader, hash Hash) error {
+	headerHash, ok := HeaderHash(header)
+	if ok && headerHash != hash {
+		return fmt.Errorf("block %d hash must be '%x' not '%x'", header.Number, headerHash, hash)
+	}
+	return nil
+}
+
+// PoA is the proof-of-authority engine: signers take turns by block number
+// and every block must be signed by a signer and be at least its seal
+// delay younger than its parent, see SealDelay.
+type PoA struct {
+	period  uint64
+	signers []Signer
+	keys    []ed25519.PublicKey
+}
+
+func NewPoA(period uint64, signers []Signer) (*PoA, error) {
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("poa consensus requires at least one signer")
+	}
+	keys := make([]ed25519.PublicKey, len(signers))
+	for i, signer := range signers {
+		key, err := hex.DecodeString(signer.PublicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key of signer '%s'", signer.Account)
+		}
+		keys[i] = key
+	}
+	return &PoA{period, signers, keys}, nil
+}
+
+func (p *PoA) Name() string {
+	return ConsensusPoA
+}
+
+func (p *PoA) Period() uint64 {
+	return p.period
+}
+
+// InTurnSigner returns the signer expected to seal the block with the given number.
+func (p *PoA) InTurnSigner(number uint64) Signer {
+	return p.signers[number%uint64(len(p.signers))]
+}
+
+// minOutOfTurnWait is the least number of seconds a signer waits for each
+// signer ahead of it in turn.
+const minOutOfTurnWait = 5
+
+// SealDelay returns how many seconds after its parent the block with the
+// given number may be sealed by account, and false when account isn't a
+// signer. The in-turn signer seals after Period. Should it be offline, the
+// signer k turns later may seal after Period plus k times the out-of-turn
+// wait, the larger of Period and minOutOfTurnWait, so the chain goes on.
+func (p *PoA) SealDelay(number uint64, account Account) (uint64, bool) {
+	i, ok := p.signerIndex(account)
+	if !ok {
+		return 0, false
+	}
+	count := uint64(len(p.signers))
+	turnsLate := (uint64(i) + count - number%count) % count
+	wait := p.period
+	if wait < minOutOfTurnWait {
+		wait = minOutOfTurnWait
+	}
+	return p.period + turnsLate*wait, true
+}
+
+func (p *PoA) signerIndex(account Account) (int, bool) {
+	for i, signer := range p.signers {
+		if signer.Account == account {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// SignerOf returns the signer owning the given public key.
+func (p *PoA) SignerOf(key ed25519.PublicKey) (Signer, bool) {
+	for i, k := range p.keys {
+		if k.Equal(key) {
+			return p.signers[i], true
+		}
+	}
+	return Signer{}, false
+}
+
+func (p *PoA) VerifyHeader(parent BlockHeader, header BlockHeader, hash Hash) error {
+	err := verifyHeaderHash(header, hash)
+	if err != nil {
+		return err
+	}
+	delay, ok := p.SealDelay(header.Number, header.Miner)
+	if !ok {
+		return fmt.Errorf("block %d is sealed by '%s' which is not a signer", header.Number, header.Miner)
+	}
+	if !header.Parent.IsEmpty() && header.Time < parent.Time+delay {
+		return fmt.Errorf("block %d time must be at least '%d' not '%d'", header.Number, parent.Time+delay, header.Time)
+	}
+	return nil
+}
+
+func (p *PoA) VerifySeal(parent Block, b Block) error {
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+	err = p.VerifyHeader(parent.Header, b.Header, hash)
+	if err != nil {
+		return err
+	}
+	i, _ := p.signerIndex(b.Header.Miner)
+	sealHash, err := b.SealHash()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(p.keys[i], sealHash[:], b.Header.Signature) {
+		return fmt.Errorf("invalid signature of block %d by '%s'", b.Header.Number, b.Header.Miner)
+	}
+	return nil
+}
+
+// SignBlock seals b for the proof-of-authority engine.
+func SignBlock(b Block, key ed25519.PrivateKey) (Block, error) {
+	sealHash, err := b.SealHash()
+	if err != nil {
+		return Block{}, err
+	}
+	b.Header.Signature = ed25519.Sign(key, sealHash[:])
+	return b, nil
+}
+
+func NewSignerKey() (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(nil)
+	return key, err
+}
+
+func LoadSignerKey(path string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("'%s' is not a hex encoded ed25519 private key", path)
+	}
+	return key, nil
+}
+
+func WriteSignerKey(path string, key ed25519.PrivateKey) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
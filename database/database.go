@@ -1,39 +1,171 @@
 package database
 
 import (
-	"bufio"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"reflect"
 )
 
-func GetBlocksAfter(blockHash Hash, dataDir string) ([]Block, error) {
-	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
+var ErrBlockNotFound = errors.New("block not found")
+
+var ErrTxNotFound = errors.New("tx not found")
+
+// ErrInsufficientBalance is returned for a TX costing more than its sender owns.
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// ErrInvalidTx is returned for a TX that is never valid, whatever the balances.
+var ErrInvalidTx = errors.New("invalid TX")
+
+// ErrInvalidBlock is returned by AddBlock for a block breaking the rules of
+// the chain. It wraps ErrInvalidTx or ErrInsufficientBalance when a TX of
+// the block is the cause.
+var ErrInvalidBlock = errors.New("invalid block")
+
+type BlockHeaderFS struct {
+	Key   Hash        `json:"hash"`
+	Value BlockHeader `json:"header"`
+}
+
+// GetBlocksAfter returns up to limit blocks following blockHash, or all of
+// them when limit is 0. An empty blockHash starts at the first block.
+func GetBlocksAfter(blockHash Hash, dataDir string, limit int) ([]Block, error) {
+	blocks := make([]Block, 0)
+	err := scanBlocksAfter(blockHash, dataDir, func(blockFs BlockFS) bool {
+		blocks = append(blocks, blockFs.Value)
+		return limit == 0 || len(blocks) < limit
+	})
 	if err != nil {
 		return nil, err
 	}
-	blocks := make([]Block, 0)
+	return blocks, nil
+}
+
+// GetHeadersAfter is GetBlocksAfter without the TXs.
+func GetHeadersAfter(blockHash Hash, dataDir string, limit int) ([]BlockHeaderFS, error) {
+	headers := make([]BlockHeaderFS, 0)
+	err := scanBlocksAfter(blockHash, dataDir, func(blockFs BlockFS) bool {
+		headers = append(headers, BlockHeaderFS{blockFs.Key, blockFs.Value.Header})
+		return limit == 0 || len(headers) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+// GetBlockByHash looks a block of the local chain up by its hash.
+func GetBlockByHash(blockHash Hash, dataDir string) (Block, error) {
+	var block Block
+	found := false
+	err := scanBlocks(dataDir, func(blockFs BlockFS) bool {
+		if blockFs.Key == blockHash {
+			block = blockFs.Value
+			found = true
+		}
+		return !found
+	})
+	if err != nil {
+		return Block{}, err
+	}
+	if !found {
+		return Block{}, fmt.Errorf("%w: '%s'", ErrBlockNotFound, blockHash.Hex())
+	}
+	return block, nil
+}
+
+// scanBlocksAfter calls collect for every block following blockHash until
+// collect returns false. It fails with ErrBlockNotFound when blockHash isn't
+// part of the local chain.
+func scanBlocksAfter(blockHash Hash, dataDir string, collect func(BlockFS) bool) error {
 	shouldStartCollecting := false
 	if reflect.DeepEqual(blockHash, Hash{}) {
 		shouldStartCollecting = true
 	}
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return nil, err
+	err := scanBlocks(dataDir, func(blockFs BlockFS) bool {
+		if shouldStartCollecting {
+			return collect(blockFs)
+		}
+		if blockHash == blockFs.Key {
+			shouldStartCollecting = true
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if !shouldStartCollecting {
+		return fmt.Errorf("%w: '%s'", ErrBlockNotFound, blockHash.Hex())
+	}
+	return nil
+}
+
+// scanBlocks calls fn for every block of block.db, oldest first, until fn
+// returns false.
+func scanBlocks(dataDir string, fn func(BlockFS) bool) error {
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return scanBlockDb(f, fn)
+}
+
+// scanBlockDb is scanBlocks for an open block.db.
+func scanBlockDb(f io.Reader, fn func(BlockFS) bool) error {
+	reader, err := newBlockRecordReader(f)
+	if err != nil {
+		return err
+	}
+	for {
+		blockFs, err := reader.Next()
+		if err == io.EOF || err == errTornRecord {
+			return nil
 		}
-		var blockFs BlockFS
-		err := json.Unmarshal(scanner.Bytes(), &blockFs)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if shouldStartCollecting {
-			blocks = append(blocks, blockFs.Value)
+		if !fn(blockFs) {
+			return nil
+		}
+	}
+}
+
+// findBlockEnd returns the offset right after the record of blockHash in
+// the block.db file f, together with the blocks stored after it.
+func findBlockEnd(f *os.File, blockHash Hash) (int64, []Block, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reader, err := newBlockRecordReader(f)
+	if err != nil {
+		return 0, nil, err
+	}
+	offset := reader.Offset()
+	found := blockHash.IsEmpty()
+	after := make([]Block, 0)
+	for {
+		blockFs, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if found {
+			after = append(after, blockFs.Value)
 			continue
 		}
-		if blockHash == blockFs.Key {
-			shouldStartCollecting = true
+		offset = reader.Offset()
+		if blockFs.Key == blockHash {
+			found = true
 		}
 	}
-	return blocks, nil
+	if !found {
+		return 0, nil, fmt.Errorf("%w: '%s'", ErrBlockNotFound, blockHash.Hex())
+	}
+	return offset, after, nil
 }
@@ -0,0 +1,252 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// BlockEncodingVersion is the header version of blocks hashed and stored
+// with the binary encoding below. Version 0 blocks predate it and keep
+// being hashed as JSON so their hashes, and the chain linking them, don't
+// change.
+//
+// From BlockTxRootVersion on the header carries the TxRoot of the block's
+// TXs and the block hash is the hash of the encoded header alone, so a
+// header can be checked against its hash without the block body.
+//
+// The encoding is canonical: every value has exactly one representation.
+// Integers are unsigned varints, except the nonce which is 4 bytes big
+// endian, and strings and byte slices are prefixed by their varint length.
+//
+//	header: version(1) parent(32) [txRoot(32)] number nonce(4) time miner signature
+//	tx:     version(1) from to value data time fee
+//	block:  header txCount tx...
+//
+// where txRoot is only present from BlockTxRootVersion on.
+const BlockEncodingVersion = 1
+
+const BlockTxRootVersion = 2
+
+const txEncodingVersion = 1
+
+var errUnexpectedEnd = errors.New("unexpected end of data")
+
+func EncodeBlockHeader(h BlockHeader) []byte {
+	e := encoder{}
+	e.header(h)
+	return e.buf
+}
+
+func EncodeTx(t Tx) []byte {
+	e := encoder{}
+	e.tx(t)
+	return e.buf
+}
+
+func EncodeBlock(b Block) []byte {
+	e := encoder{}
+	e.header(b.Header)
+	e.txs(b.Txs)
+	return e.buf
+}
+
+func DecodeBlockHeader(data []byte) (BlockHeader, error) {
+	d := decoder{data: data}
+	h := d.header()
+	return h, d.finish()
+}
+
+func DecodeTx(data []byte) (Tx, error) {
+	d := decoder{data: data}
+	t := d.tx()
+	return t, d.finish()
+}
+
+func DecodeBlock(data []byte) (Block, error) {
+	d := decoder{data: data}
+	b := Block{Header: d.header()}
+	count := d.uvarint()
+	// Every TX takes at least 7 bytes, anything claiming more TXs than
+	// that can't be satisfied by the remaining data.
+	if d.err == nil && count > uint64(len(d.data))/7 {
+		d.fail(fmt.Errorf("block claims %d TXs in %d bytes", count, len(d.data)))
+	}
+	if d.err == nil && count > 0 {
+		b.Txs = make([]Tx, count)
+		for i := range b.Txs {
+			b.Txs[i] = d.tx()
+		}
+	}
+	return b, d.finish()
+}
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) header(h BlockHeader) {
+	e.buf = append(e.buf, h.Version)
+	e.buf = append(e.buf, h.Parent[:]...)
+	if h.Version >= BlockTxRootVersion {
+		e.buf = append(e.buf, h.TxRoot[:]...)
+	}
+	e.uvarint(h.Number)
+	var nonce [4]byte
+	binary.BigEndian.PutUint32(nonce[:], h.Nonce)
+	e.buf = append(e.buf, nonce[:]...)
+	e.uvarint(h.Time)
+	e.bytes([]byte(h.Miner))
+	e.bytes(h.Signature)
+}
+
+func (e *encoder) txs(txs []Tx) {
+	e.uvarint(uint64(len(txs)))
+	for _, tx := range txs {
+		e.tx(tx)
+	}
+}
+
+func (e *encoder) tx(t Tx) {
+	e.buf = append(e.buf, txEncodingVersion)
+	e.bytes([]byte(t.From))
+	e.bytes([]byte(t.To))
+	e.uvarint(uint64(t.Value))
+	e.bytes([]byte(t.Data))
+	e.uvarint(t.Time)
+	e.uvarint(uint64(t.Fee))
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder reads what encoder wrote. The first error sticks and turns every
+// following read into a no-op.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) header() BlockHeader {
+	h := BlockHeader{}
+	h.Version = d.byte()
+	if d.err == nil && h.Version > BlockTxRootVersion {
+		d.fail(fmt.Errorf("unknown block version %d", h.Version))
+	}
+	copy(h.Parent[:], d.fixed(len(h.Parent)))
+	if h.Version >= BlockTxRootVersion {
+		copy(h.TxRoot[:], d.fixed(len(h.TxRoot)))
+	}
+	h.Number = d.uvarint()
+	nonce := d.fixed(4)
+	if d.err == nil {
+		h.Nonce = binary.BigEndian.Uint32(nonce)
+	}
+	h.Time = d.uvarint()
+	h.Miner = Account(d.bytes())
+	if signature := d.bytes(); len(signature) > 0 {
+		h.Signature = signature
+	}
+	return h
+}
+
+func (d *decoder) tx() Tx {
+	t := Tx{}
+	version := d.byte()
+	if d.err == nil && version != txEncodingVersion {
+		d.fail(fmt.Errorf("unknown TX version %d", version))
+	}
+	t.From = Account(d.bytes())
+	t.To = Account(d.bytes())
+	t.Value = d.uint()
+	t.Data = string(d.bytes())
+	t.Time = d.uvarint()
+	t.Fee = d.uint()
+	return t
+}
+
+func (d *decoder) byte() byte {
+	b := d.fixed(1)
+	if d.err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) fixed(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.fail(errUnexpectedEnd)
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid varint"))
+		return 0
+	}
+	// A non-minimal varint would give a second encoding of the same value.
+	if n > 1 && d.data[n-1] == 0 {
+		d.fail(fmt.Errorf("non canonical varint"))
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) uint() uint {
+	v := d.uvarint()
+	if uint64(uint(v)) != v {
+		d.fail(fmt.Errorf("value %d overflows uint", v))
+		return 0
+	}
+	return uint(v)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.data)) {
+		d.fail(errUnexpectedEnd)
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.fixed(int(n)))
+	return b
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *decoder) finish() error {
+	if d.err != nil {
+		return d.err
+	}
+	if len(d.data) > 0 {
+		return fmt.Errorf("%d trailing bytes", len(d.data))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func FuzzDecodeBlockRecord(f *testing.F) {
+	txs := []Tx{
+		NewCoinbaseTx("andrej", BlockReward, 1),
+		NewTx("andrej", "babayaga", 1, "fuzz"),
+	}
+	legacy := Block{BlockHeader{Number: 1, Time: 1, Miner: "andrej"}, txs[1:]}
+	encoded := legacy
+	encoded.Header.Version = BlockEncodingVersion
+	encoded.Txs = txs
+	signed := NewBlock(Hash{1}, 2, 3, 4, "andrej", txs)
+	signed.Header.Signature = []byte("signature")
+	for _, b := range []Block{legacy, encoded, signed, NewBlock(Hash{}, 0, 0, 0, "", nil)} {
+		hash, err := b.Hash()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encodeBlockRecord(BlockFS{hash, b}))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		content := append(append([]byte(nil), blockDbMagic...), data...)
+		reader, err := newBlockRecordReader(bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			start := reader.Offset()
+			blockFs, err := reader.Next()
+			if err != nil {
+				return
+			}
+			record := content[start:reader.Offset()]
+
+			// The payload of a decodable record is the canonical encoding
+			// of the block it decodes to.
+			_, n := binary.Uvarint(record)
+			payload := append(append([]byte(nil), blockFs.Key[:]...), EncodeBlock(blockFs.Value)...)
+			if !bytes.Equal(record[n+4:], payload) {
+				t.Fatalf("block %+v doesn't encode back to its record %x", blockFs, record)
+			}
+
+			reencoded := encodeBlockRecord(blockFs)
+			again, err := newBlockRecordReader(bytes.NewReader(append(append([]byte(nil), blockDbMagic...), reencoded...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := again.Next()
+			if err != nil {
+				t.Fatalf("decoding the re-encoded record failed: %s", err)
+			}
+			if !reflect.DeepEqual(decoded, blockFs) {
+				t.Fatalf("round trip changed the block: %+v != %+v", decoded, blockFs)
+			}
+		}
+	})
+}
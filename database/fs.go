@@ -1,6 +1,7 @@
 package database
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -16,6 +17,14 @@ func initDataDirIfNotExists(dataDir string) error {
 	if err := writeGenesisToDisk(getGenesisJsonFilePath(dataDir)); err != nil {
 		return err
 	}
+	return writeDataDirVersion(dataDir, LatestDataDirVersion())
+}
+
+// checkDataDirExists fails for a dataDir never initialised by a node.
+func checkDataDirExists(dataDir string) error {
+	if !fileExist(getGenesisJsonFilePath(dataDir)) {
+		return fmt.Errorf("'%s' isn't a data dir, its genesis file is missing", dataDir)
+	}
 	return nil
 }
 
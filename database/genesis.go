@@ -16,7 +16,24 @@ var genesisJson = `
 `
 
 type genesis struct {
-	Balances map[Account]uint `json:"balances"`
+	Balances       map[Account]uint `json:"balances"`
+	Consensus      ConsensusConfig  `json:"consensus"`
+	MonetaryPolicy *MonetaryPolicy  `json:"monetary_policy"`
+}
+
+func (g genesis) supply() uint {
+	var supply uint
+	for _, balance := range g.Balances {
+		supply += balance
+	}
+	return supply
+}
+
+func (g genesis) monetaryPolicy() MonetaryPolicy {
+	if g.MonetaryPolicy == nil {
+		return DefaultMonetaryPolicy
+	}
+	return *g.MonetaryPolicy
 }
 
 func loadGenesis(path string) (genesis, error) {
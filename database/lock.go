@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrDataDirLocked is returned when another process has the data dir open
+// for writing.
+var ErrDataDirLocked = errors.New("data dir is locked")
+
+// ErrReadOnly is returned when writing to a State opened read-only.
+var ErrReadOnly = errors.New("state is read-only")
+
+// errLockHeld is returned by lockFile when another process holds the lock.
+var errLockHeld = errors.New("lock held by another process")
+
+const lockFileName = "LOCK"
+
+func getLockFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), lockFileName)
+}
+
+// dataDirLock is an exclusive lock on the database dir, held from the
+// moment a State is opened for writing until it's closed. The lock file
+// holds the PID of its owner. It's left in place on release, the lock
+// itself being owned by the open file and released by the OS when the
+// process dies.
+type dataDirLock struct {
+	f *os.File
+}
+
+func lockDataDir(dataDir string) (*dataDirLock, error) {
+	f, err := os.OpenFile(getLockFilePath(dataDir), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err == errLockHeld {
+		owner := readLockOwner(f)
+		f.Close()
+		return nil, fmt.Errorf("%w: '%s' is in use by process %s, stop it or use a read-only command", ErrDataDirLocked, dataDir, owner)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		unlockFile(f)
+		f.Close()
+		return nil, err
+	}
+	return &dataDirLock{f}, nil
+}
+
+func readLockOwner(f *os.File) string {
+	content, err := io.ReadAll(io.NewSectionReader(f, 0, 32))
+	pid := strings.TrimSpace(string(content))
+	if err != nil || pid == "" {
+		return "unknown"
+	}
+	return pid
+}
+
+func (l *dataDirLock) release() error {
+	if l == nil {
+		return nil
+	}
+	err := unlockFile(l.f)
+	if err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package database
+
+import "os"
+
+// lockFile doesn't lock anything where flock isn't available, the lock
+// file is still written so the owner of the data dir can be found.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
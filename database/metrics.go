@@ -0,0 +1,15 @@
+package database
+
+import "blocks/metrics"
+
+var (
+	chainHeight = metrics.NewGauge(
+		"tbb_chain_height",
+		"Number of the latest block of the local chain.",
+	)
+	blockImportSeconds = metrics.NewHistogram(
+		"tbb_block_import_seconds",
+		"Time taken to validate, persist and index a block.",
+		metrics.DefaultBuckets,
+	)
+)
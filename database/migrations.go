@@ -0,0 +1,208 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrDataDirTooNew is returned for a data dir written by a newer tbb.
+var ErrDataDirTooNew = errors.New("data dir was written by a newer version of tbb")
+
+// ErrDataDirOutdated is returned when opening read-only, exporting or
+// verifying a data dir that needs migrating first.
+var ErrDataDirOutdated = errors.New("data dir needs migrating")
+
+const (
+	versionFileName = "VERSION"
+	backupsDirName  = "backups"
+)
+
+// migration upgrades the data dir from one layout version to the next.
+// apply gets the dir the database dir was backed up to before the first
+// step ran, steps may replace files whose only other copy is there.
+type migration struct {
+	description string
+	apply       func(dataDir string, backupDir string) error
+}
+
+// migrations[i] turns a data dir at version i+1 into version i+2. A data
+// dir without a VERSION file predates it and is at version 1. New layouts
+// are supported by appending a step, never by editing a released one.
+var migrations = []migration{
+	{"convert block.db from JSON lines to the binary format", func(dataDir string, backupDir string) error {
+		return migrateJsonBlockDb(getBlocksDbFilePath(dataDir), backupDir)
+	}},
+}
+
+// LatestDataDirVersion is the layout version of data dirs written by this
+// build.
+func LatestDataDirVersion() int {
+	return len(migrations) + 1
+}
+
+// MigrationReport describes what MigrateDataDir applied.
+type MigrationReport struct {
+	FromVersion int
+	ToVersion   int
+	Applied     []string
+	BackupDir   string
+}
+
+// MigrateDataDir upgrades dataDir to LatestDataDirVersion. NewStateFromDisk
+// does the same when opening an older data dir.
+func MigrateDataDir(dataDir string) (MigrationReport, error) {
+	err := checkDataDirExists(dataDir)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	lock, err := lockDataDir(dataDir)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	defer lock.release()
+	return migrateDataDir(dataDir)
+}
+
+// migrateDataDir applies the missing migrations one at a time, writing the
+// version reached after each, so an interrupted run resumes where it
+// stopped. The database dir is copied to a backup dir first. The data dir
+// lock must be held.
+func migrateDataDir(dataDir string) (MigrationReport, error) {
+	version, err := readDataDirVersion(dataDir)
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	report := MigrationReport{FromVersion: version, ToVersion: version, Applied: make([]string, 0)}
+	if version > LatestDataDirVersion() {
+		return report, fmt.Errorf("%w: '%s' is at version %d, this build supports up to %d", ErrDataDirTooNew, dataDir, version, LatestDataDirVersion())
+	}
+	if version == LatestDataDirVersion() {
+		return report, nil
+	}
+
+	report.BackupDir, err = backupDatabaseDir(dataDir, version)
+	if err != nil {
+		return report, fmt.Errorf("backing up '%s' before migrating it failed: %w", dataDir, err)
+	}
+	slog.Info("backed up the data dir before migrating it", "backup", report.BackupDir)
+
+	for ; version < LatestDataDirVersion(); version++ {
+		step := migrations[version-1]
+		slog.Info("migrating the data dir", "from", version, "to", version+1, "step", step.description)
+		err = step.apply(dataDir, report.BackupDir)
+		if err != nil {
+			return report, fmt.Errorf("migrating '%s' to version %d failed, its previous content is in '%s': %w", dataDir, version+1, report.BackupDir, err)
+		}
+		err = writeDataDirVersion(dataDir, version+1)
+		if err != nil {
+			return report, err
+		}
+		report.ToVersion = version + 1
+		report.Applied = append(report.Applied, step.description)
+	}
+	return report, nil
+}
+
+// checkDataDirVersion fails unless dataDir is at LatestDataDirVersion.
+func checkDataDirVersion(dataDir string) error {
+	err := checkDataDirExists(dataDir)
+	if err != nil {
+		return err
+	}
+	version, err := readDataDirVersion(dataDir)
+	if err != nil {
+		return err
+	}
+	if version > LatestDataDirVersion() {
+		return fmt.Errorf("%w: '%s' is at version %d, this build supports up to %d", ErrDataDirTooNew, dataDir, version, LatestDataDirVersion())
+	}
+	if version < LatestDataDirVersion() {
+		return fmt.Errorf("%w: '%s' is at version %d, run `tbb db migrate` to upgrade it to %d", ErrDataDirOutdated, dataDir, version, LatestDataDirVersion())
+	}
+	return nil
+}
+
+func getVersionFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), versionFileName)
+}
+
+func readDataDirVersion(dataDir string) (int, error) {
+	content, err := os.ReadFile(getVersionFilePath(dataDir))
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid data dir version '%s' in '%s'", strings.TrimSpace(string(content)), getVersionFilePath(dataDir))
+	}
+	return version, nil
+}
+
+// writeDataDirVersion replaces the VERSION file atomically.
+func writeDataDirVersion(dataDir string, version int) error {
+	path := getVersionFilePath(dataDir)
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, []byte(strconv.Itoa(version)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// backupDatabaseDir copies the files of the database dir, the lock file
+// aside, to backups/database-v<version>-<time> beside it, so backups are
+// never part of the next backup. They aren't pruned, each holds a full copy
+// of block.db until removed by hand.
+func backupDatabaseDir(dataDir string, version int) (string, error) {
+	dbDir := getDatabaseDirPath(dataDir)
+	backupDir := filepath.Join(dataDir, backupsDirName, fmt.Sprintf("database-v%d-%s", version, time.Now().UTC().Format("20060102T150405")))
+	err := os.MkdirAll(backupDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	entries, err := os.ReadDir(dbDir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == lockFileName {
+			continue
+		}
+		err = copyFile(filepath.Join(dbDir, entry.Name()), filepath.Join(backupDir, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+	}
+	return backupDir, nil
+}
+
+func copyFile(from string, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+package database
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestInspectingOutdatedDataDirFails(t *testing.T) {
+	dataDir, _, _, _ := writeTestChain(t, 1)
+	err := writeDataDirVersion(dataDir, LatestDataDirVersion()-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewReadOnlyStateFromDisk(dataDir)
+	if !errors.Is(err, ErrDataDirOutdated) {
+		t.Errorf("read-only open must fail with ErrDataDirOutdated, got: %v", err)
+	}
+	_, err = VerifyChain(dataDir)
+	if !errors.Is(err, ErrDataDirOutdated) {
+		t.Errorf("verify must fail with ErrDataDirOutdated, got: %v", err)
+	}
+	_, err = ExportChain(dataDir, io.Discard, 0, 0, false)
+	if !errors.Is(err, ErrDataDirOutdated) {
+		t.Errorf("export must fail with ErrDataDirOutdated, got: %v", err)
+	}
+}
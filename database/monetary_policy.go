@@ -0,0 +1,47 @@
+package database
+
+import "fmt"
+
+// MonetaryPolicy is the "monetary_policy" section of genesis.json. It
+// defines the reward credited to the miner of every block.
+type MonetaryPolicy struct {
+	InitialReward uint `json:"initial_reward"`
+	// HalvingInterval is the number of blocks after which the reward halves.
+	// Zero disables halving.
+	HalvingInterval uint64 `json:"halving_interval"`
+	// MaxSupply caps the sum of all balances. Zero means unlimited.
+	MaxSupply uint `json:"max_supply"`
+}
+
+// DefaultMonetaryPolicy is used by chains whose genesis has no
+// monetary_policy: a constant BlockReward forever.
+var DefaultMonetaryPolicy = MonetaryPolicy{InitialReward: BlockReward}
+
+func (p MonetaryPolicy) validate(genesisSupply uint) error {
+	if p.MaxSupply > 0 && genesisSupply > p.MaxSupply {
+		return fmt.Errorf("genesis balances of %d TBB exceed the max supply of %d TBB", genesisSupply, p.MaxSupply)
+	}
+	return nil
+}
+
+// BlockReward returns the reward of the block with the given number on top
+// of a chain that has already issued supply TBB in total.
+func (p MonetaryPolicy) BlockReward(number uint64, supply uint) uint {
+	reward := p.InitialReward
+	if p.HalvingInterval > 0 {
+		halvings := number / p.HalvingInterval
+		if halvings >= 64 {
+			return 0
+		}
+		reward >>= halvings
+	}
+	if p.MaxSupply > 0 {
+		if supply >= p.MaxSupply {
+			return 0
+		}
+		if p.MaxSupply-supply < reward {
+			reward = p.MaxSupply - supply
+		}
+	}
+	return reward
+}
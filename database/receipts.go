@@ -0,0 +1,115 @@
+package database
+
+import "fmt"
+
+// Receipt describes how a TX of the local chain changed balances. The
+// coinbase TX of a block has a receipt too, splitting its value into the
+// block reward and the fees of the block's TXs.
+type Receipt struct {
+	TxHash      Hash   `json:"tx_hash"`
+	BlockHash   Hash   `json:"block_hash"`
+	BlockNumber uint64 `json:"block_number"`
+	// Index is the position of the TX in its block.
+	Index int `json:"index"`
+	Tx    Tx  `json:"tx"`
+	// Debited is what the sender paid, the value plus the fee, and
+	// Credited what the receiver got.
+	Debited  uint `json:"debited"`
+	Credited uint `json:"credited"`
+	Coinbase bool `json:"coinbase"`
+	Reward   uint `json:"reward,omitempty"`
+	Fees     uint `json:"fees,omitempty"`
+}
+
+// BlockReceipts returns the receipts of the TXs of a block, in block order.
+// Blocks mined before coinbase TXs credited their reward implicitly, it
+// appears in no receipt.
+func BlockReceipts(blockFs BlockFS) ([]Receipt, error) {
+	b := blockFs.Value
+	receipts := make([]Receipt, 0, len(b.Txs))
+	legacy := isLegacyBlock(b)
+	for i, tx := range b.Txs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			return nil, err
+		}
+		receipt := Receipt{
+			TxHash:      txHash,
+			BlockHash:   blockFs.Key,
+			BlockNumber: b.Header.Number,
+			Index:       i,
+			Tx:          tx,
+			Credited:    tx.Value,
+		}
+		switch {
+		case i == 0 && !legacy:
+			fees, err := blockFees(b.Txs[1:])
+			if err != nil {
+				return nil, err
+			}
+			receipt.Coinbase = true
+			receipt.Fees = fees
+			receipt.Reward = tx.Value - fees
+		case legacy:
+			receipt.Debited = tx.Value
+		default:
+			receipt.Debited, err = tx.Cost()
+			if err != nil {
+				return nil, err
+			}
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+// Receipt returns the receipt of a TX of the local chain.
+func (s *State) Receipt(txHash Hash) (Receipt, error) {
+	_, blockFs, err := s.TxByHash(txHash)
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipts, err := BlockReceipts(blockFs)
+	if err != nil {
+		return Receipt{}, err
+	}
+	for _, receipt := range receipts {
+		if receipt.TxHash == txHash {
+			return receipt, nil
+		}
+	}
+	return Receipt{}, fmt.Errorf("%w: '%s'", ErrTxNotFound, txHash.Hex())
+}
+
+// AccountHistory returns the receipts of the TXs sending to or from
+// account, coinbase TXs paying it included, oldest first and starting with
+// the block numbered from. It stops at the first block past limit receipts,
+// the receipts of a block are never split, so the next page starts with the
+// block after the last receipt.
+func (s *State) AccountHistory(account Account, from uint64, limit int) ([]Receipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	history := make([]Receipt, 0)
+	for _, position := range s.index.byAccount[account] {
+		if len(history) >= limit {
+			break
+		}
+		if s.index.firstNumber+uint64(position) < from {
+			continue
+		}
+		blockFs, err := readBlockRecord(s.dbFile, s.index.offsets[position])
+		if err != nil {
+			return nil, err
+		}
+		receipts, err := BlockReceipts(blockFs)
+		if err != nil {
+			return nil, err
+		}
+		for _, receipt := range receipts {
+			if receipt.Tx.From == account || receipt.Tx.To == account {
+				history = append(history, receipt)
+			}
+		}
+	}
+	return history, nil
+}
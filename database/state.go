@@ -1,73 +1,256 @@
 package database
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"sync"
+	"time"
 )
 
 type SnapShot [32]byte
 
 type State struct {
-	Balances        map[Account]uint
+	// mu guards the balances, the tip, the supply and the block index.
+	// AddBlock and RollbackTo hold it for writing, so readers never see a
+	// block half applied or block.db being truncated.
+	mu              sync.RWMutex
+	balances        map[Account]uint
 	dbFile          *os.File
+	fsync           FsyncPolicy
 	latestBlock     Block
 	latestBlockHash Hash
 	hasGenesisBlock bool
+	engine          ConsensusEngine
+	policy          MonetaryPolicy
+	genesis         genesis
+	genesisSupply   uint
+	supply          uint
+	index           blockIndex
+	logger          *slog.Logger
+	readOnly        bool
+	lock            *dataDirLock
 }
 
-func NewStateFromDisk(dataDir string) (*State, error) {
+// StateOption customises a State opened by NewStateFromDisk.
+type StateOption func(s *State)
+
+// WithFsyncPolicy sets when appended blocks are flushed to stable storage.
+// The default is FsyncAlways.
+func WithFsyncPolicy(policy FsyncPolicy) StateOption {
+	return func(s *State) {
+		s.fsync = policy
+	}
+}
+
+// WithLogger sets the logger of the state, slog.Default() otherwise.
+func WithLogger(logger *slog.Logger) StateOption {
+	return func(s *State) {
+		s.logger = logger
+	}
+}
+
+// NewStateFromDisk opens the state of dataDir for writing, creating the
+// data dir on first use and migrating it when it's at an older version. It
+// fails with ErrDataDirLocked while another process has it open, the lock
+// being held until Close.
+func NewStateFromDisk(dataDir string, opts ...StateOption) (*State, error) {
+	state, err := newGenesisState(dataDir, FsyncAlways)
+	if err != nil {
+		return nil, err
+	}
+	return loadState(state, opts)
+}
+
+// NewReadOnlyStateFromDisk opens the state of dataDir for inspection. It
+// doesn't take the data dir lock, so it can be used while a node runs, and
+// never writes: the data dir must exist at the latest version, a torn
+// trailing record is ignored and AddBlock and RollbackTo fail with
+// ErrReadOnly.
+func NewReadOnlyStateFromDisk(dataDir string, opts ...StateOption) (*State, error) {
+	f, err := openReadOnlyBlockDb(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	state, err := newStateFromGenesis(getGenesisJsonFilePath(dataDir))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	state.dbFile = f
+	state.readOnly = true
+	return loadState(state, opts)
+}
+
+// openReadOnlyBlockDb opens block.db of dataDir for reading, without the
+// data dir lock. Every read-only access goes through it, so it fails with
+// ErrDataDirOutdated unless dataDir is at the latest version.
+func openReadOnlyBlockDb(dataDir string) (*os.File, error) {
+	err := checkDataDirVersion(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(getBlocksDbFilePath(dataDir))
+}
+
+func loadState(state *State, opts []StateOption) (*State, error) {
+	for _, opt := range opts {
+		opt(state)
+	}
+	err := state.load()
+	if err != nil {
+		state.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+// newGenesisState locks dataDir and opens its block.db and genesis file for
+// writing, without replaying any block.
+func newGenesisState(dataDir string, fsync FsyncPolicy) (*State, error) {
 	err := initDataDirIfNotExists(dataDir)
 	if err != nil {
 		return nil, err
 	}
+	lock, err := lockDataDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	_, err = migrateDataDir(dataDir)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
 
-	gen, err := loadGenesis(getGenesisJsonFilePath(dataDir))
+	state, err := openGenesisState(dataDir, fsync)
 	if err != nil {
+		lock.release()
 		return nil, err
 	}
+	state.lock = lock
+	return state, nil
+}
 
-	balances := make(map[Account]uint)
-	for account, balance := range gen.Balances {
-		balances[account] = balance
+func openGenesisState(dataDir string, fsync FsyncPolicy) (*State, error) {
+	state, err := newStateFromGenesis(getGenesisJsonFilePath(dataDir))
+	if err != nil {
+		return nil, err
 	}
 
-	dbFilepath := getBlocksDbFilePath(dataDir)
-	f, err := os.OpenFile(dbFilepath, os.O_APPEND|os.O_RDWR, 0600)
+	f, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
 	}
+	err = initBlockDb(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
 
-	scanner := bufio.NewScanner(f)
+	state.dbFile = f
+	state.fsync = fsync
+	return state, nil
+}
 
-	state := &State{balances, f, Block{}, Hash{}, false}
+// newStateFromGenesis builds the state described by the genesis file at
+// path, without any block.db attached.
+func newStateFromGenesis(path string) (*State, error) {
+	gen, err := loadGenesis(path)
+	if err != nil {
+		return nil, err
+	}
 
-	for scanner.Scan() {
-		if err := scanner.Err(); err != nil {
-			return nil, err
-		}
+	engine, err := NewConsensusEngine(gen.Consensus)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := gen.monetaryPolicy()
+	err = policy.validate(gen.supply())
+	if err != nil {
+		return nil, err
+	}
+
+	state := &State{
+		engine:  engine,
+		policy:  policy,
+		genesis: gen,
+		logger:  slog.Default(),
+	}
+	state.reset()
+	return state, nil
+}
+
+// reset brings the state back to the genesis balances.
+func (s *State) reset() {
+	s.balances = make(map[Account]uint)
+	for account, balance := range s.genesis.Balances {
+		s.balances[account] = balance
+	}
+	s.genesisSupply = s.genesis.supply()
+	s.supply = s.genesisSupply
+	s.latestBlock = Block{}
+	s.latestBlockHash = Hash{}
+	s.hasGenesisBlock = false
+	s.index = newBlockIndex()
+}
+
+// load resets the state to the genesis balances and replays every block
+// stored in block.db on top of them. A torn trailing record, left behind by
+// a crash in the middle of an append, is truncated with a warning, or
+// skipped on a read-only state where it may be a block being appended.
+func (s *State) load() error {
+	s.reset()
+	defer func() {
+		chainHeight.Set(float64(s.latestBlock.Header.Number))
+	}()
+
+	_, err := s.dbFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader, err := newBlockRecordReader(s.dbFile)
+	if err != nil {
+		return err
+	}
 
-		blockFsJson := scanner.Bytes()
-		if len(blockFsJson) == 0 {
-			break
+	for {
+		offset := reader.Offset()
+		blockFs, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == errTornRecord && s.readOnly {
+			return nil
+		}
+		if err == errTornRecord {
+			backupPath, removed, err := cutBlockDb(s.dbFile, reader.Offset())
+			if err != nil {
+				return err
+			}
+			s.logger.Warn("truncated an incomplete record at the end of block.db", "bytes", removed, "backup", backupPath)
+			return nil
 		}
-		var blockFs BlockFS
-		err = json.Unmarshal(blockFsJson, &blockFs)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("%w, run `tbb db repair` to truncate it after the last valid block", err)
 		}
 
-		err := applyBlock(blockFs.Value, state)
+		err = applyBlock(blockFs.Value, s)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		s.latestBlock = blockFs.Value
+		s.latestBlockHash = blockFs.Key
+		s.hasGenesisBlock = true
+		err = s.index.add(blockFs.Key, blockFs.Value, offset)
+		if err != nil {
+			return err
 		}
-		state.latestBlock = blockFs.Value
-		state.latestBlockHash = blockFs.Key
 	}
-	return state, nil
 }
 
 func (s *State) AddBlocks(blocks []Block) error {
@@ -79,49 +262,194 @@ func (s *State) AddBlocks(blocks []Block) error {
 	}
 	return nil
 }
+// AddBlock applies b on top of the latest block and appends it to block.db.
+// Version 0 blocks are rejected, the legacy rules they may be applied with
+// are only for the blocks already stored, see isLegacyBlock.
 func (s *State) AddBlock(b Block) (Hash, error) {
+	if s.readOnly {
+		return Hash{}, ErrReadOnly
+	}
+	if b.Header.Version == 0 {
+		return Hash{}, fmt.Errorf("%w: block %d has version 0, new blocks must be at version %d or later", ErrInvalidBlock, b.Header.Number, BlockEncodingVersion)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := time.Now()
 	pendingState := s.copy()
-	err := applyBlock(b, &pendingState)
+	err := applyBlock(b, pendingState)
 	if err != nil {
-		return Hash{}, err
+		return Hash{}, fmt.Errorf("%w: %w", ErrInvalidBlock, err)
 	}
 	blockHash, err := b.Hash()
 	if err != nil {
 		return Hash{}, err
 	}
-	BlockFs := BlockFS{blockHash, b}
-	BlockFsJson, err := json.Marshal(BlockFs)
-	if err != nil {
-		return Hash{}, err
-	}
-	fmt.Printf("\npersisting new Block to disk:\n")
-	fmt.Printf("\t%s\n", BlockFsJson)
-	_, err = s.dbFile.Write(append(BlockFsJson, '\n'))
+	offset, err := appendBlockRecord(s.dbFile, BlockFS{blockHash, b}, s.fsync)
 	if err != nil {
 		return Hash{}, err
 	}
-	s.Balances = pendingState.Balances
+	s.balances = pendingState.balances
+	s.supply = pendingState.supply
 	s.latestBlockHash = blockHash
 	s.latestBlock = b
+	s.hasGenesisBlock = true
+	err = s.index.add(blockHash, b, offset)
+	if err != nil {
+		return blockHash, err
+	}
+	s.logger.Debug("persisted block", "block", blockHash.Hex(), "height", b.Header.Number)
+	chainHeight.Set(float64(b.Header.Number))
+	blockImportSeconds.Observe(time.Since(start).Seconds())
 	return blockHash, nil
 }
+
+// RollbackTo removes every block following hash from block.db and rebuilds
+// the balances without them. An empty hash removes all blocks. The removed
+// blocks are returned oldest first.
+func (s *State) RollbackTo(hash Hash) ([]Block, error) {
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, removed, err := findBlockEnd(s.dbFile, hash)
+	if err != nil {
+		return nil, err
+	}
+	err = s.dbFile.Truncate(offset)
+	if err != nil {
+		return nil, err
+	}
+	err = s.dbFile.Sync()
+	if err != nil {
+		return nil, err
+	}
+	return removed, s.load()
+}
+
+// BlockLocator lists hashes of the local chain from the tip backwards: the
+// 10 most recent blocks one by one, then with exponentially growing gaps,
+// always ending with the first block.
+func (s *State) BlockLocator() []Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hashes := s.index.hashes
+	locator := make([]Hash, 0)
+	step := 1
+	for i := len(hashes) - 1; i >= 0; i -= step {
+		locator = append(locator, hashes[i])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	if len(hashes) > 0 && locator[len(locator)-1] != hashes[0] {
+		locator = append(locator, hashes[0])
+	}
+	return locator
+}
+
+// CommonAncestor returns the first hash of locator that is part of the
+// local chain, or the empty hash when the chains share no block.
+func (s *State) CommonAncestor(locator []Hash) Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, hash := range locator {
+		if _, ok := s.index.byHash[hash]; ok {
+			return hash
+		}
+	}
+	return Hash{}
+}
 func (s *State) LatestBlock() Block {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.latestBlock
 }
 func (s *State) LatestBlockHash() Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.latestBlockHash
 }
 
+// Balances returns a copy of the balances at the latest block, together
+// with the hash of that block.
+func (s *State) Balances() (Hash, map[Account]uint) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	balances := make(map[Account]uint, len(s.balances))
+	for account, balance := range s.balances {
+		balances[account] = balance
+	}
+	return s.latestBlockHash, balances
+}
+
+// Balance returns the balance of account at the latest block.
+func (s *State) Balance(account Account) uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.balances[account]
+}
+
+// MonetaryPolicy returns the block reward schedule configured by the genesis file.
+func (s *State) MonetaryPolicy() MonetaryPolicy {
+	return s.policy
+}
+
+// GenesisSupply is the sum of the genesis balances.
+func (s *State) GenesisSupply() uint {
+	return s.genesisSupply
+}
+
+// Supply is the total amount of TBB issued so far, genesis balances included.
+func (s *State) Supply() uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.supply
+}
+
+// NextBlockReward is the reward the miner of the next block receives.
+func (s *State) NextBlockReward() uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.policy.BlockReward(s.latestBlock.Header.Number+1, s.supply)
+}
+
+// Engine returns the consensus engine configured by the genesis file.
+func (s *State) Engine() ConsensusEngine {
+	return s.engine
+}
+
+// Close flushes block.db to disk, whatever the fsync policy, closes it and
+// releases the data dir lock.
 func (s *State) Close() error {
-	return s.dbFile.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if !s.readOnly {
+		err = s.dbFile.Sync()
+	}
+	closeErr := s.dbFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	lockErr := s.lock.release()
+	if err == nil {
+		err = lockErr
+	}
+	return err
 }
-func (s *State) copy() State {
-	c := State{}
+func (s *State) copy() *State {
+	c := &State{}
 	c.latestBlock = s.latestBlock
-	c.latestBlockHash = s.LatestBlockHash()
-	c.Balances = make(map[Account]uint)
-	for acc, balance := range s.Balances {
-		c.Balances[acc] = balance
+	c.latestBlockHash = s.latestBlockHash
+	c.hasGenesisBlock = s.hasGenesisBlock
+	c.engine = s.engine
+	c.policy = s.policy
+	c.genesisSupply = s.genesisSupply
+	c.supply = s.supply
+	c.balances = make(map[Account]uint)
+	for acc, balance := range s.balances {
+		c.balances[acc] = balance
 	}
 	return c
 }
@@ -135,25 +463,113 @@ func applyBlock(b Block, s *State) error {
 	if s.hasGenesisBlock && s.latestBlock.Header.Number > 0 && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
 		return fmt.Errorf("next block parent hash must be '%x' not '%x'", s.latestBlockHash, b.Header.Parent)
 	}
-	hash, err := b.Hash()
+
+	if !s.hasGenesisBlock && !b.Header.Parent.IsEmpty() {
+		return fmt.Errorf("first block must not have a parent, got '%x'", b.Header.Parent)
+	}
+	err := verifyTxRoot(b)
 	if err != nil {
 		return err
 	}
-	if !IsBlockHashValid(hash) {
-		return fmt.Errorf("Invalid block hash  %x", hash)
+	err = s.engine.VerifySeal(s.latestBlock, b)
+	if err != nil {
+		return err
 	}
 
-	err = applyTXs(b.Txs, s)
+	if isLegacyBlock(b) {
+		return applyLegacyBlock(b, s)
+	}
+
+	if len(b.Txs) == 0 || !b.Txs[0].IsCoinbase() {
+		return fmt.Errorf("block %d must start with a coinbase TX", b.Header.Number)
+	}
+	coinbase := b.Txs[0]
+	txs := b.Txs[1:]
+	if coinbase.To != b.Header.Miner {
+		return fmt.Errorf("coinbase TX must pay miner '%s' not '%s'", b.Header.Miner, coinbase.To)
+	}
+	reward := s.policy.BlockReward(b.Header.Number, s.supply)
+	fees, err := blockFees(txs)
 	if err != nil {
 		return err
 	}
-	s.Balances[b.Header.Miner] += BlockReward
-	return nil
+	expected, ok := AddAmounts(reward, fees)
+	if !ok {
+		return fmt.Errorf("%w: block %d reward %d plus fees %d overflows", ErrInvalidTx, b.Header.Number, reward, fees)
+	}
+	if coinbase.Value != expected {
+		return fmt.Errorf("coinbase TX value must be '%d' (reward %d + fees %d) not '%d'", expected, reward, fees, coinbase.Value)
+	}
+
+	err = s.credit(coinbase.To, coinbase.Value)
+	if err != nil {
+		return err
+	}
+	s.supply, ok = AddAmounts(s.supply, reward)
+	if !ok {
+		return fmt.Errorf("%w: block %d reward overflows the supply", ErrInvalidTx, b.Header.Number)
+	}
+
+	return applyTXs(txs, s)
 }
-func applyTXs(txs []Tx, s *State) error {
-	sort.Slice(txs, func(i, j int) bool {
+
+// isLegacyBlock reports whether b was mined before coinbase TXs, with the
+// reward credited implicitly. Such blocks keep the rules they were mined
+// with, see applyLegacyBlock. Since AddBlock rejects version 0 blocks, they
+// are only met when replaying, repairing or verifying block.db.
+func isLegacyBlock(b Block) bool {
+	return b.Header.Version == 0 && (len(b.Txs) == 0 || !b.Txs[0].IsCoinbase())
+}
+
+// applyLegacyBlock applies b the way blocks were applied before coinbase
+// TXs: its TXs, which carry no fees, in time order, then the block reward
+// credited to the miner.
+func applyLegacyBlock(b Block, s *State) error {
+	txs := make([]Tx, len(b.Txs))
+	copy(txs, b.Txs)
+	sort.SliceStable(txs, func(i, j int) bool {
 		return txs[i].Time < txs[j].Time
 	})
+	for _, tx := range txs {
+		if tx.Fee != 0 {
+			return fmt.Errorf("%w: TXs of block %d can't pay fees without a coinbase TX", ErrInvalidTx, b.Header.Number)
+		}
+		if tx.Value > s.balances[tx.From] {
+			return fmt.Errorf("%w: sender '%s' balance is %d TBB, TX cost is %d TBB", ErrInsufficientBalance, tx.From, s.balances[tx.From], tx.Value)
+		}
+		s.balances[tx.From] -= tx.Value
+		err := s.credit(tx.To, tx.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	reward := s.policy.BlockReward(b.Header.Number, s.supply)
+	err := s.credit(b.Header.Miner, reward)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	s.supply, ok = AddAmounts(s.supply, reward)
+	if !ok {
+		return fmt.Errorf("%w: block %d reward overflows the supply", ErrInvalidTx, b.Header.Number)
+	}
+	return nil
+}
+
+func blockFees(txs []Tx) (uint, error) {
+	var fees uint
+	for _, tx := range txs {
+		var ok bool
+		fees, ok = AddAmounts(fees, tx.Fee)
+		if !ok {
+			return 0, fmt.Errorf("%w: sum of the block fees overflows", ErrInvalidTx)
+		}
+	}
+	return fees, nil
+}
+
+func applyTXs(txs []Tx, s *State) error {
 	for _, tx := range txs {
 		err := applyTx(tx, s)
 		if err != nil {
@@ -164,10 +580,41 @@ func applyTXs(txs []Tx, s *State) error {
 	return nil
 }
 func applyTx(tx Tx, s *State) error {
-	if tx.Value > s.Balances[tx.From] {
-		return fmt.Errorf("wrong TX. Sender '%s' balance is %d TBB. Tx cost is %d TBB", tx.From, s.Balances[tx.From], tx.Value)
+	if tx.From == "" || tx.IsReward() {
+		return fmt.Errorf("%w: only the coinbase TX may issue rewards", ErrInvalidTx)
+	}
+	cost, err := tx.Cost()
+	if err != nil {
+		return err
 	}
-	s.Balances[tx.From] -= tx.Value
-	s.Balances[tx.To] += tx.Value
+	if cost > s.balances[tx.From] {
+		return fmt.Errorf("%w: sender '%s' balance is %d TBB, TX cost is %d TBB", ErrInsufficientBalance, tx.From, s.balances[tx.From], cost)
+	}
+	s.balances[tx.From] -= cost
+	return s.credit(tx.To, tx.Value)
+}
+
+// credit adds value to the balance of account.
+func (s *State) credit(account Account, value uint) error {
+	balance, ok := AddAmounts(s.balances[account], value)
+	if !ok {
+		return fmt.Errorf("%w: crediting %d TBB to '%s' overflows its balance", ErrInvalidTx, value, account)
+	}
+	s.balances[account] = balance
 	return nil
 }
+
+// CheckWritable fails when new blocks couldn't be persisted, because
+// block.db is gone or its directory no longer accepts writes.
+func (s *State) CheckWritable() error {
+	_, err := s.dbFile.Stat()
+	if err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(filepath.Dir(s.dbFile.Name()), ".probe-*")
+	if err != nil {
+		return fmt.Errorf("database directory is not writable: %w", err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
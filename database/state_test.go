@@ -0,0 +1,33 @@
+package database
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAddBlockRejectsLegacyBlocks(t *testing.T) {
+	dataDir, key, _, _ := writeTestChain(t, 1)
+	state, err := NewStateFromDisk(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	tip := state.LatestBlockHash()
+
+	// A version 0 block without coinbase would get the implicit reward
+	// without paying the miner through a coinbase TX.
+	next := nextTestBlock(t, state, key)
+	legacy := Block{next.Header, next.Txs[1:]}
+	legacy.Header.Version = 0
+	legacy, err = SignBlock(legacy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = state.AddBlock(legacy)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("adding a version 0 block must fail with ErrInvalidBlock, got: %v", err)
+	}
+	if state.LatestBlockHash() != tip {
+		t.Errorf("the legacy block must not become the tip")
+	}
+}
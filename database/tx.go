@@ -2,7 +2,7 @@ package database
 
 import (
 	"crypto/sha256"
-	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -18,20 +18,45 @@ type Tx struct {
 	Value uint    `json:"value"`
 	Data  string  `json:"data"`
 	Time  uint64  `json:"time"`
+	Fee   uint    `json:"fee,omitempty"`
 }
 
 func NewTx(from Account, to Account, value uint, data string) Tx {
-	return Tx{from, to, value, data, uint64(time.Now().Unix())}
+	return Tx{from, to, value, data, uint64(time.Now().Unix()), 0}
+}
+
+// NewCoinbaseTx credits the block reward plus the fees of the block's TXs
+// to the miner. It must be the first TX of every block.
+func NewCoinbaseTx(miner Account, value uint, time uint64) Tx {
+	return Tx{"", miner, value, "reward", time, 0}
 }
 
 func (t Tx) IsReward() bool {
 	return t.Data == "reward"
 }
 
-func (t Tx) Hash() (Hash, error) {
-	txJson, err := json.Marshal(t)
-	if err != nil {
-		return Hash{}, err
+func (t Tx) IsCoinbase() bool {
+	return t.From == "" && t.IsReward()
+}
+
+// Cost is the amount debited from the sender. It fails with ErrInvalidTx
+// when the value plus the fee doesn't fit a uint.
+func (t Tx) Cost() (uint, error) {
+	cost, ok := AddAmounts(t.Value, t.Fee)
+	if !ok {
+		return 0, fmt.Errorf("%w: value %d plus fee %d overflows", ErrInvalidTx, t.Value, t.Fee)
 	}
-	return sha256.Sum256(txJson), nil
+	return cost, nil
+}
+
+// AddAmounts returns a+b, and false when the sum doesn't fit a uint. Sums
+// of amounts taken from TXs must go through it, a wrapped around sum would
+// let a TX spend or mint more than it pays for.
+func AddAmounts(a uint, b uint) (uint, bool) {
+	sum := a + b
+	return sum, sum >= a
+}
+
+func (t Tx) Hash() (Hash, error) {
+	return sha256.Sum256(EncodeTx(t)), nil
 }
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// VerifyReport is the result of VerifyChain.
+type VerifyReport struct {
+	Blocks          int
+	LatestBlockHash Hash
+	Height          uint64
+	Balances        map[Account]uint
+	// BadBlock is the first block failing verification, nil if the whole
+	// chain is valid. Balances then reflect the chain up to its parent.
+	BadBlock *BadBlock
+}
+
+type BadBlock struct {
+	Index  int
+	Number uint64
+	Hash   Hash
+	Reason string
+}
+
+// ExpectedState is the format of the file VerifyChain's balances can be
+// compared to, the same as database/state.json.
+type ExpectedState struct {
+	Balances map[Account]uint `json:"balances"`
+}
+
+type BalanceDiff struct {
+	Account  Account
+	Expected uint
+	Actual   uint
+}
+
+// VerifyChain walks block.db of dataDir from the genesis and checks every
+// block: its stored hash, height, parent link, seal, TXs and coinbase. The
+// datadir is only read, never migrated or repaired: like
+// NewReadOnlyStateFromDisk it fails with ErrDataDirOutdated for a data dir
+// that needs migrating.
+func VerifyChain(dataDir string) (VerifyReport, error) {
+	f, err := openReadOnlyBlockDb(dataDir)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer f.Close()
+	state, err := newStateFromGenesis(getGenesisJsonFilePath(dataDir))
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	report := VerifyReport{Balances: state.balances}
+	reader, err := newBlockRecordReader(f)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	for {
+		blockFs, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			number := uint64(0)
+			if state.hasGenesisBlock {
+				number = state.latestBlock.Header.Number + 1
+			}
+			report.BadBlock = &BadBlock{Index: report.Blocks, Number: number, Reason: err.Error()}
+			break
+		}
+
+		err = verifyBlock(state, blockFs)
+		if err != nil {
+			report.BadBlock = &BadBlock{report.Blocks, blockFs.Value.Header.Number, blockFs.Key, err.Error()}
+			break
+		}
+		report.Blocks++
+	}
+
+	report.Balances = state.balances
+	report.LatestBlockHash = state.latestBlockHash
+	report.Height = state.latestBlock.Header.Number
+	return report, nil
+}
+
+func verifyBlock(s *State, blockFs BlockFS) error {
+	b := blockFs.Value
+	hash, err := b.Hash()
+	if err != nil {
+		return err
+	}
+	if hash != blockFs.Key {
+		return fmt.Errorf("stored hash '%s' doesn't match the block hash '%s'", blockFs.Key.Hex(), hash.Hex())
+	}
+	if s.hasGenesisBlock {
+		if b.Header.Number != s.latestBlock.Header.Number+1 {
+			return fmt.Errorf("height must be '%d' not '%d'", s.latestBlock.Header.Number+1, b.Header.Number)
+		}
+		if b.Header.Parent != s.latestBlockHash {
+			return fmt.Errorf("parent hash must be '%s' not '%s'", s.latestBlockHash.Hex(), b.Header.Parent.Hex())
+		}
+	}
+
+	pendingState := s.copy()
+	err = applyBlock(b, pendingState)
+	if err != nil {
+		return err
+	}
+	s.balances = pendingState.balances
+	s.supply = pendingState.supply
+	s.latestBlock = b
+	s.latestBlockHash = hash
+	s.hasGenesisBlock = true
+	return nil
+}
+
+func LoadExpectedState(path string) (ExpectedState, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ExpectedState{}, err
+	}
+	var expected ExpectedState
+	err = json.Unmarshal(content, &expected)
+	if err != nil {
+		return ExpectedState{}, err
+	}
+	return expected, nil
+}
+
+// DiffBalances lists the accounts whose balance differs, sorted by account.
+// A missing account counts as a zero balance.
+func DiffBalances(expected map[Account]uint, actual map[Account]uint) []BalanceDiff {
+	diffs := make([]BalanceDiff, 0)
+	for account, balance := range expected {
+		if actual[account] != balance {
+			diffs = append(diffs, BalanceDiff{account, balance, actual[account]})
+		}
+	}
+	for account, balance := range actual {
+		if _, ok := expected[account]; !ok && balance != 0 {
+			diffs = append(diffs, BalanceDiff{account, 0, balance})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Account < diffs[j].Account
+	})
+	return diffs
+}
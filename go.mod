@@ -1,9 +1,10 @@
 module blocks
 
-go 1.18
+go 1.21
+
+require github.com/spf13/cobra v1.5.0
 
 require (
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
-	github.com/spf13/cobra v1.5.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 )
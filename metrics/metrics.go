@@ -0,0 +1,280 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format. Metrics are created once, as
+// package variables of the package they instrument, and register themselves
+// with Default.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics written together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+// Default is the registry metrics created by NewCounter, NewGauge and
+// NewHistogram register with.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(m *metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[m.name] {
+		panic(fmt.Sprintf("metric '%s' registered twice", m.name))
+	}
+	r.names[m.name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes all metrics in the Prometheus text format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+
+	var b strings.Builder
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ContentType is the content type of the text format written by WriteTo.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// metric is a named family of series, one per combination of label values.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts, sum and count are only used by histograms. counts[i] holds
+	// the observations falling into buckets[i], not the cumulative count.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetric(name string, help string, kind string, labels []string, buckets []float64) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+	Default.register(m)
+	return m
+}
+
+// get returns the series of labelValues, creating it on first use. It must
+// be called with m.mu held.
+func (m *metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric '%s' takes %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == typeHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// delete forgets the series of labelValues.
+func (m *metric) delete(labelValues []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.series, strings.Join(labelValues, "\xff"))
+}
+
+func (m *metric) write(b *strings.Builder) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(b, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	// A metric without labels is written even before its first update.
+	if len(m.labels) == 0 && len(keys) == 0 {
+		m.get(nil)
+		keys = append(keys, "")
+	}
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != typeHistogram {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, upperBound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, formatValue(upperBound)), cumulative)
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelPairs(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, m.labelPairs(s.labelValues, ""), formatValue(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name, m.labelPairs(s.labelValues, ""), s.count)
+	}
+}
+
+// labelPairs formats the labels of a series, plus the le label of histogram
+// buckets when le isn't empty.
+func (m *metric) labelPairs(labelValues []string, le string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, value := range labelValues {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", m.labels[i], escapeLabelValue(value)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+// Counter is a value that only goes up, such as the number of requests.
+type Counter struct {
+	m *metric
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{newMetric(name, help, typeCounter, labels, nil)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter by v, which must not be negative.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter '%s' can't decrease", c.m.name))
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(labelValues).value += v
+}
+
+// Delete removes the series of labelValues, for label values that won't be
+// seen again such as a removed peer.
+func (c *Counter) Delete(labelValues ...string) {
+	c.m.delete(labelValues)
+}
+
+// Gauge is a value that goes up and down, such as the number of peers.
+type Gauge struct {
+	m *metric
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{newMetric(name, help, typeGauge, labels, nil)}
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(labelValues).value += v
+}
+
+// Histogram counts observations, such as request durations, into buckets.
+type Histogram struct {
+	m *metric
+}
+
+// DefaultBuckets suit durations in seconds from a millisecond to 10s.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// NewHistogram creates a histogram with the upper bounds of buckets, which
+// must be sorted. The +Inf bucket is implied.
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("buckets of histogram '%s' aren't sorted", name))
+	}
+	return &Histogram{newMetric(name, help, typeHistogram, labels, buckets)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+	s := h.m.get(labelValues)
+	for i, upperBound := range h.m.buckets {
+		if v <= upperBound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
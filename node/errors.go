@@ -0,0 +1,76 @@
+package node
+
+import (
+	"blocks/database"
+	"errors"
+	"net/http"
+)
+
+// Errors of the node API. Wrap them with %w so writeErrRes responds with the
+// matching status and error code.
+var (
+	ErrBadRequest       = errors.New("bad request")
+	ErrNotFound         = errors.New("not found")
+	ErrConflict         = errors.New("conflict")
+	ErrMethodNotAllowed = errors.New("method not allowed")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrUnavailable      = errors.New("unavailable")
+)
+
+// apiError ties an error to the HTTP status and the stable code of the error
+// responses carrying it. Clients should branch on the code, messages change.
+type apiError struct {
+	err    error
+	status int
+	code   string
+}
+
+const errCodeInternal = "internal"
+
+var apiErrors = []apiError{
+	{ErrBadRequest, http.StatusBadRequest, "bad_request"},
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrConflict, http.StatusConflict, "conflict"},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed"},
+	{ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{ErrRateLimited, http.StatusTooManyRequests, "rate_limited"},
+	{ErrUnavailable, http.StatusServiceUnavailable, "unavailable"},
+	{database.ErrBlockNotFound, http.StatusNotFound, "block_not_found"},
+	{database.ErrTxNotFound, http.StatusNotFound, "tx_not_found"},
+	{database.ErrInsufficientBalance, http.StatusUnprocessableEntity, "insufficient_balance"},
+	{database.ErrInvalidTx, http.StatusUnprocessableEntity, "invalid_tx"},
+	{database.ErrInvalidBlock, http.StatusUnprocessableEntity, "invalid_block"},
+}
+
+// errStatus returns the HTTP status and error code of err, 500 and
+// errCodeInternal for errors of no known kind.
+func errStatus(err error) (int, string) {
+	for _, apiErr := range apiErrors {
+		if errors.Is(err, apiErr.err) {
+			return apiErr.status, apiErr.code
+		}
+	}
+	return http.StatusInternalServerError, errCodeInternal
+}
+
+// ResError is an error response received from another node. It unwraps to
+// the error its code stands for so callers can use errors.Is on it.
+type ResError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ResError) Error() string {
+	return e.Message
+}
+
+func (e *ResError) Unwrap() error {
+	for _, apiErr := range apiErrors {
+		if apiErr.code == e.Code {
+			return apiErr.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package node
+
+import (
+	"blocks/database"
+	"sync"
+)
+
+const (
+	EventBlock            = "block"
+	EventPendingTx        = "pending_tx"
+	EventTxMined          = "tx_mined"
+	EventReorg            = "reorg"
+	EventPeerConnected    = "peer_connected"
+	EventPeerDisconnected = "peer_disconnected"
+)
+
+// eventSubscriberBuffer is how many events a subscriber may fall behind
+// before it gets dropped. Syncing imports blocks in bursts of hundreds.
+const eventSubscriberBuffer = 1024
+
+// Event is something that happened to the node, as streamed to clients.
+// Data is a BlockRes, BlockTxRes, TxMinedEvent, ReorgEvent or PeerNode
+// depending on Type.
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	// accounts are the accounts the event touches, see EventFilter.
+	accounts []database.Account
+}
+
+type TxMinedEvent struct {
+	Hash        database.Hash `json:"hash"`
+	Tx          database.Tx   `json:"tx"`
+	BlockHash   database.Hash `json:"block_hash"`
+	BlockNumber uint64        `json:"block_number"`
+}
+
+type ReorgEvent struct {
+	Ancestor database.Hash   `json:"ancestor"`
+	Orphaned []database.Hash `json:"orphaned"`
+	Tip      database.Hash   `json:"tip"`
+}
+
+// EventFilter selects the events a subscriber receives. Empty fields match
+// everything. An account matches the events touching it, and reorgs since
+// they may change any balance.
+type EventFilter struct {
+	Types   map[string]bool
+	Account database.Account
+}
+
+func (f EventFilter) matches(e Event) bool {
+	if len(f.Types) > 0 && !f.Types[e.Type] {
+		return false
+	}
+	if f.Account == "" || e.Type == EventReorg {
+		return true
+	}
+	for _, account := range e.accounts {
+		if account == f.Account {
+			return true
+		}
+	}
+	return false
+}
+
+type eventSubscriber struct {
+	filter EventFilter
+	events chan Event
+}
+
+// eventBus is how the parts of the node, the miner and the API streams,
+// learn about new blocks, TXs and peers. It fans events out without ever
+// blocking the publisher: a subscriber whose buffer is full is dropped and
+// its channel closed, so a stalled client can't hold up TX intake or block
+// imports. Subscribers that must not miss events subscribe again.
+type eventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*eventSubscriber]struct{})}
+}
+
+func (b *eventBus) subscribe(filter EventFilter) *eventSubscriber {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := &eventSubscriber{filter, make(chan Event, eventSubscriberBuffer)}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+func (b *eventBus) publish(eventType string, data interface{}, accounts ...database.Account) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	event := Event{b.nextID, eventType, data, accounts}
+	for sub := range b.subscribers {
+		if !sub.filter.matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// publishBlock announces a block added to the local chain together with
+// its TXs.
+func (n *Node) publishBlock(block database.Block, hash database.Hash) {
+	blockRes, err := newBlockRes(database.BlockFS{Key: hash, Value: block})
+	if err != nil {
+		return
+	}
+	accounts := []database.Account{block.Header.Miner}
+	for _, tx := range blockRes.Txs {
+		if !tx.IsCoinbase() {
+			accounts = append(accounts, tx.From, tx.To)
+		}
+	}
+	n.events.publish(EventBlock, blockRes, accounts...)
+
+	for _, tx := range blockRes.Txs {
+		if tx.IsCoinbase() {
+			continue
+		}
+		n.events.publish(EventTxMined, TxMinedEvent{tx.Hash, tx.Tx, hash, block.Header.Number}, tx.From, tx.To)
+	}
+}
@@ -0,0 +1,61 @@
+package node
+
+import (
+	"blocks/database"
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStalledSubscriberDoesNotBlockPublishers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	n := New(t.TempDir(), DefaultIP, 0, database.NewAccount("andrej"), PeerNode{}, WithLogger(logger))
+	state, err := database.NewStateFromDisk(n.dataDir, database.WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	n.state = state
+
+	// Never read from, it falls behind as soon as its buffer is full.
+	stalled := n.events.subscribe(EventFilter{})
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2*eventSubscriberBuffer; i++ {
+			err := n.AddPendingTX(database.NewTx("andrej", "babayaga", 1, strconv.Itoa(i)), n.Info)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		for i := 0; i < eventSubscriberBuffer; i++ {
+			n.events.publish(EventPeerConnected, n.Info)
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddPendingTX and publish blocked on a subscriber that never reads")
+	}
+
+	// The stalled subscriber was dropped with its buffer full, its channel
+	// closed after the buffered events.
+	received := 0
+	for range stalled.events {
+		received++
+	}
+	if received != eventSubscriberBuffer {
+		t.Errorf("stalled subscriber must get the %d buffered events, got %d", eventSubscriberBuffer, received)
+	}
+	if len(n.pendingTXs) != 2*eventSubscriberBuffer {
+		t.Errorf("all %d TXs must be pending, %d are", 2*eventSubscriberBuffer, len(n.pendingTXs))
+	}
+}
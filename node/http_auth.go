@@ -0,0 +1,174 @@
+package node
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type access int
+
+const (
+	accessPublic access = iota
+	accessAdmin
+)
+
+type adminCtxKey struct{}
+
+// handle registers handler behind the API token check and the rate limiter.
+// Requests are measured under pattern, see observeRequest.
+func (n *Node) handle(mux *http.ServeMux, pattern string, level access, handler http.HandlerFunc) {
+	mux.HandleFunc(pattern, observeRequest(pattern, func(w http.ResponseWriter, r *http.Request) {
+		admin, err := n.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrRes(w, err)
+			return
+		}
+		if level == accessAdmin && !admin {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrRes(w, fmt.Errorf("%w: '%s' requires an API token", ErrUnauthorized, r.URL.Path))
+			return
+		}
+		if !admin || len(n.apiTokens) == 0 {
+			if ok, retryAfter := n.rateLimiter.allow(clientIP(r), time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+				writeErrRes(w, fmt.Errorf("%w: too many requests from %s", ErrRateLimited, clientIP(r)))
+				return
+			}
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), adminCtxKey{}, admin)))
+	}))
+}
+
+// authenticate reports whether r carries a valid API token. Every request is
+// an admin one while no token is configured, Run then only serves loopback
+// clients and handle still rate limits them. A wrong token is an error
+// rather than a public request, to make misconfigured clients obvious.
+func (n *Node) authenticate(r *http.Request) (bool, error) {
+	if len(n.apiTokens) == 0 {
+		return true, nil
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return false, nil
+	}
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return false, fmt.Errorf("%w: the Authorization header must use the Bearer scheme", ErrUnauthorized)
+	}
+	for _, apiToken := range n.apiTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(apiToken)) == 1 {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%w: invalid API token", ErrUnauthorized)
+}
+
+// isAdminReq reports whether a request passed to a handler was authenticated.
+func isAdminReq(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminCtxKey{}).(bool)
+	return admin
+}
+
+// listenAddr is the address the API is served on. Without API tokens it's
+// restricted to the loopback IP of the node, anyone reaching the API being
+// an admin.
+func (n *Node) listenAddr() (string, error) {
+	if len(n.apiTokens) > 0 {
+		return fmt.Sprintf(":%d", n.Info.Port), nil
+	}
+	if !isLoopback(n.Info.IP) {
+		return "", fmt.Errorf("refusing to serve the API on '%s' without an API token, configure one or use a loopback IP", n.Info.IP)
+	}
+	return net.JoinHostPort(n.Info.IP, strconv.FormatUint(n.Info.Port, 10)), nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter keeps a token bucket per client IP. Buckets of idle clients
+// are forgotten after rateLimiterIdleTimeout.
+type rateLimiter struct {
+	mu        sync.Mutex
+	perSecond float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const rateLimiterIdleTimeout = 10 * time.Minute
+
+// newRateLimiter returns nil, a limiter allowing everything, when perSecond
+// isn't positive.
+func newRateLimiter(perSecond float64, burst int) *rateLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		perSecond: perSecond,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of ip. When it's empty it returns
+// false and how long until the next token.
+func (l *rateLimiter) allow(ip string, now time.Time) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > rateLimiterIdleTimeout {
+		for bucketIP, bucket := range l.buckets {
+			if now.Sub(bucket.last) > rateLimiterIdleTimeout {
+				delete(l.buckets, bucketIP)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = &tokenBucket{l.burst, now}
+		l.buckets[ip] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.perSecond)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
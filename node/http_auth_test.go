@@ -0,0 +1,38 @@
+package node
+
+import (
+	"blocks/database"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizationHeaderRequiresBearerScheme(t *testing.T) {
+	n := New(t.TempDir(), DefaultIP, 0, database.NewAccount("andrej"), PeerNode{}, WithAPITokens([]string{"secret"}))
+	mux := http.NewServeMux()
+	n.handle(mux, "/admin", accessAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		header string
+		status int
+	}{
+		{"Bearer secret", http.StatusOK},
+		{"secret", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		res := httptest.NewRecorder()
+		mux.ServeHTTP(res, req)
+		if res.Code != test.status {
+			t.Errorf("Authorization '%s' must get status %d, got %d", test.header, test.status, res.Code)
+		}
+	}
+}
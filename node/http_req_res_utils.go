@@ -1,16 +1,22 @@
 package node
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"time"
 )
 
+// writeErrRes responds with the status and error code matching the kind of
+// err, see errStatus.
 func writeErrRes(w http.ResponseWriter, err error) {
-	jsonErrRes, _ := json.Marshal(ErrRes{err.Error()})
+	status, code := errStatus(err)
+	jsonErrRes, _ := json.Marshal(ErrRes{err.Error(), code})
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
 	w.Write(jsonErrRes)
 }
 
@@ -18,6 +24,7 @@ func writeRes(w http.ResponseWriter, content interface{}) {
 	contentJson, err := json.Marshal(content)
 	if err != nil {
 		writeErrRes(w, err)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -32,7 +39,7 @@ func readReq(r *http.Request, reqBody interface{}) error {
 	defer r.Body.Close()
 	err = json.Unmarshal(reqBodyJson, reqBody)
 	if err != nil {
-		return fmt.Errorf("Unable to unmarshal the request body .%s ", err.Error())
+		return fmt.Errorf("%w: unable to unmarshal the request body. %s", ErrBadRequest, err.Error())
 	}
 	return nil
 }
@@ -49,3 +56,89 @@ func readRes(r *http.Response, reqBody interface{}) error {
 	}
 	return nil
 }
+
+// apiClient calls the HTTP API of other nodes. Requests carry token, when
+// set, so they reach admin endpoints and skip rate limiting. The zero value
+// talks plain HTTP through http.DefaultClient.
+type apiClient struct {
+	token  string
+	scheme string
+	http   *http.Client
+}
+
+const apiClientTimeout = 30 * time.Second
+
+// newAPIClient returns a client speaking HTTPS when tlsConfig is enabled.
+func newAPIClient(token string, tlsConfig TLSConfig) (apiClient, error) {
+	if !tlsConfig.enabled() {
+		return apiClient{token, "http", &http.Client{Timeout: apiClientTimeout}}, nil
+	}
+	clientConfig, err := tlsConfig.clientConfig()
+	if err != nil {
+		return apiClient{}, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = clientConfig
+	return apiClient{token, "https", &http.Client{Transport: transport, Timeout: apiClientTimeout}}, nil
+}
+
+// peerURL returns the URL of endpoint on peer, with query when not nil.
+func (c apiClient) peerURL(peer PeerNode, endpoint string, query url.Values) string {
+	scheme := c.scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	peerURL := url.URL{Scheme: scheme, Host: peer.TcpAddress(), Path: endpoint}
+	if query != nil {
+		peerURL.RawQuery = query.Encode()
+	}
+	return peerURL.String()
+}
+
+func (c apiClient) getJson(url string, content interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, content)
+}
+
+func (c apiClient) postJson(url string, reqBody interface{}, content interface{}) error {
+	reqBodyJson, err := json.Marshal(reqBody)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(reqBodyJson))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, content)
+}
+
+func (c apiClient) do(req *http.Request, content interface{}) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	client := c.http
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return readErrRes(res)
+	}
+	return readRes(res, content)
+}
+
+func readErrRes(res *http.Response) error {
+	errRes := ErrRes{}
+	err := readRes(res, &errRes)
+	if err != nil || errRes.Error == "" {
+		return &ResError{res.StatusCode, errRes.Code, fmt.Sprintf("unexpected status %d", res.StatusCode)}
+	}
+	return &ResError{res.StatusCode, errRes.Code, errRes.Error}
+}
@@ -2,13 +2,17 @@ package node
 
 import (
 	"blocks/database"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type ErrRes struct {
 	Error string `json:"error"`
+	Code  string `json:"code"`
 }
 type AddPeerRes struct {
 	Success bool   `json:"success"`
@@ -18,20 +22,48 @@ type AddPeerRes struct {
 type SyncRes struct {
 	Blocks []database.Block `json:"blocks"`
 }
+type HeadersRes struct {
+	Headers []database.BlockHeaderFS `json:"headers"`
+}
+
+type LocateReq struct {
+	Locator []database.Hash `json:"locator"`
+	Limit   int             `json:"limit"`
+}
+
+type LocateRes struct {
+	Ancestor database.Hash            `json:"ancestor"`
+	Headers  []database.BlockHeaderFS `json:"headers"`
+}
+
 type BalanceRes struct {
 	Hash     database.Hash             `json:"block_hash"`
 	Balances map[database.Account]uint `json:"balances"`
 }
 
+type SupplyRes struct {
+	Hash            database.Hash `json:"block_hash"`
+	Number          uint64        `json:"block_number"`
+	GenesisSupply   uint          `json:"genesis_supply"`
+	IssuedRewards   uint          `json:"issued_rewards"`
+	TotalSupply     uint          `json:"total_supply"`
+	MaxSupply       uint          `json:"max_supply"`
+	InitialReward   uint          `json:"initial_reward"`
+	HalvingInterval uint64        `json:"halving_interval"`
+	NextBlockReward uint          `json:"next_block_reward"`
+}
+
 type TxAddReq struct {
 	From  string `json:"from"`
 	To    string `json:"to"`
 	Value uint   `json:"value"`
+	Fee   uint   `json:"fee"`
 	Data  string `json:"data"`
 }
 
 type TxAddRes struct {
-	Success bool `json:"success"`
+	Success bool          `json:"success"`
+	Hash    database.Hash `json:"hash"`
 }
 
 type StatusRes struct {
@@ -41,8 +73,88 @@ type StatusRes struct {
 	PendingTXs []database.Tx       `json:"pending_txs"`
 }
 
+type HealthRes struct {
+	Status string `json:"status"`
+}
+
+type ReadyRes struct {
+	Ready          bool   `json:"ready"`
+	Height         uint64 `json:"height"`
+	BestPeerHeight uint64 `json:"best_peer_height"`
+	Peers          int    `json:"peers"`
+}
+
+type SyncProgressRes struct {
+	Height          uint64  `json:"height"`
+	BestPeer        string  `json:"best_peer"`
+	BestPeerHeight  uint64  `json:"best_peer_height"`
+	BlocksBehind    uint64  `json:"blocks_behind"`
+	Syncing         bool    `json:"syncing"`
+	BlocksPerSecond float64 `json:"blocks_per_second"`
+	// EtaSeconds is 0 once synced and -1 while the import rate is unknown.
+	EtaSeconds float64 `json:"eta_seconds"`
+}
+
+type WorkRes struct {
+	ID     string           `json:"id"`
+	Parent database.Hash    `json:"parent"`
+	Number uint64           `json:"number"`
+	Time   uint64           `json:"time"`
+	Miner  database.Account `json:"miner"`
+	Reward uint             `json:"reward"`
+	Txs    []database.Tx    `json:"txs"`
+	Target string           `json:"target"`
+}
+
+type BlockRes struct {
+	Hash   database.Hash        `json:"hash"`
+	Header database.BlockHeader `json:"header"`
+	Txs    []BlockTxRes         `json:"txs"`
+}
+
+type BlockTxRes struct {
+	Hash database.Hash `json:"hash"`
+	database.Tx
+}
+
+type BlocksRes struct {
+	Blocks []BlockRes `json:"blocks"`
+}
+
+type AccountHistoryRes struct {
+	Account  database.Account   `json:"account"`
+	Receipts []database.Receipt `json:"receipts"`
+}
+
+type SubmitWorkReq struct {
+	ID    string `json:"id"`
+	Nonce uint32 `json:"nonce"`
+	Time  uint64 `json:"time"`
+}
+
+type SubmitWorkRes struct {
+	Success bool          `json:"success"`
+	Hash    database.Hash `json:"block_hash"`
+}
+
 func listBalanceHandler(w http.ResponseWriter, r *http.Request, state *database.State) {
-	writeRes(w, BalanceRes{state.LatestBlockHash(), state.Balances})
+	hash, balances := state.Balances()
+	writeRes(w, BalanceRes{hash, balances})
+}
+
+func supplyHandler(w http.ResponseWriter, r *http.Request, state *database.State) {
+	policy := state.MonetaryPolicy()
+	writeRes(w, SupplyRes{
+		Hash:            state.LatestBlockHash(),
+		Number:          state.LatestBlock().Header.Number,
+		GenesisSupply:   state.GenesisSupply(),
+		IssuedRewards:   state.Supply() - state.GenesisSupply(),
+		TotalSupply:     state.Supply(),
+		MaxSupply:       policy.MaxSupply,
+		InitialReward:   policy.InitialReward,
+		HalvingInterval: policy.HalvingInterval,
+		NextBlockReward: state.NextBlockReward(),
+	})
 }
 
 func txAddHandler(w http.ResponseWriter, r *http.Request, node *Node) {
@@ -52,47 +164,157 @@ func txAddHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 		writeErrRes(w, err)
 		return
 	}
-	tx := database.NewTx(database.NewAccount(req.From), database.NewAccount(req.To), req.Value, req.Data)
-	err = node.AddPendingTX(tx, node.Info)
+	res, err := node.addTx(req)
 	if err != nil {
-		writeRes(w, err)
+		writeErrRes(w, err)
 		return
 	}
-	writeRes(w, TxAddRes{true})
+	writeRes(w, res)
 }
 
 func statusHandler(w http.ResponseWriter, r *http.Request, node *Node) {
-	res := StatusRes{
-		Hash:       node.state.LatestBlockHash(),
-		Number:     node.state.LatestBlock().Header.Number,
-		KnownPeers: node.knownPeers,
-		PendingTXs: node.getPendingTXsAsArray(),
+	writeRes(w, node.status())
+}
+
+// healthHandler reports whether the process is alive and can still
+// persist blocks.
+func healthHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	err := node.state.CheckWritable()
+	if err != nil {
+		writeErrRes(w, fmt.Errorf("%w: %s", ErrUnavailable, err))
+		return
+	}
+	writeRes(w, HealthRes{"ok"})
+}
+
+// readyHandler reports whether the node should receive traffic: its state
+// is loaded, it reached a peer and it's at most readyMaxBlocksBehind blocks
+// behind the highest peer.
+func readyHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	if node.state == nil {
+		writeErrRes(w, fmt.Errorf("%w: state is not loaded", ErrUnavailable))
+		return
+	}
+	height := node.state.LatestBlock().Header.Number
+	res := ReadyRes{Height: height, Peers: node.progress.peers()}
+
+	reasons := make([]string, 0)
+	if res.Peers == 0 {
+		reasons = append(reasons, "no peer reached yet")
+	}
+	if _, bestHeight, ok := node.progress.bestPeer(); ok {
+		res.BestPeerHeight = bestHeight
+		if bestHeight > height+readyMaxBlocksBehind {
+			reasons = append(reasons, fmt.Sprintf("%d blocks behind the best peer", bestHeight-height))
+		}
+	}
+	if len(reasons) > 0 {
+		writeErrRes(w, fmt.Errorf("%w: not ready, %s", ErrUnavailable, strings.Join(reasons, ", ")))
+		return
+	}
+	res.Ready = true
+	writeRes(w, res)
+}
+
+func syncProgressHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	height := node.state.LatestBlock().Header.Number
+	res := SyncProgressRes{Height: height}
+	if bestPeer, bestHeight, ok := node.progress.bestPeer(); ok {
+		res.BestPeer = bestPeer
+		res.BestPeerHeight = bestHeight
+		if bestHeight > height {
+			res.BlocksBehind = bestHeight - height
+		}
+	}
+	res.BlocksPerSecond, res.Syncing = node.progress.rate(height, time.Now())
+	switch {
+	case res.BlocksBehind == 0:
+		res.EtaSeconds = 0
+	case res.BlocksPerSecond > 0:
+		res.EtaSeconds = float64(res.BlocksBehind) / res.BlocksPerSecond
+	default:
+		res.EtaSeconds = -1
 	}
 	writeRes(w, res)
 }
 
 func syncHandler(w http.ResponseWriter, r *http.Request, node *Node) {
-	reqHash := r.URL.Query().Get(endpointSyncQueryKeyFromBlock)
-	hash := database.Hash{}
-	err := hash.UnmarshalText([]byte(reqHash))
+	hash, limit, err := readSyncQuery(r)
 	if err != nil {
 		writeErrRes(w, err)
 		return
 	}
-	blocks, err := database.GetBlocksAfter(hash, node.dataDir)
+	blocks, err := database.GetBlocksAfter(hash, node.dataDir, limit)
 	if err != nil {
 		writeErrRes(w, err)
 		return
 	}
 	writeRes(w, SyncRes{Blocks: blocks})
 }
+
+func headersHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	hash, limit, err := readSyncQuery(r)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	headers, err := database.GetHeadersAfter(hash, node.dataDir, limit)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, HeadersRes{Headers: headers})
+}
+
+func locateHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	req := LocateReq{}
+	err := readReq(r, &req)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	if req.Limit <= 0 || req.Limit > maxSyncPageSize {
+		req.Limit = maxSyncPageSize
+	}
+	ancestor := node.state.CommonAncestor(req.Locator)
+	headers, err := database.GetHeadersAfter(ancestor, node.dataDir, req.Limit)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, LocateRes{ancestor, headers})
+}
+
+// readSyncQuery parses the fromBlock and limit query params. The limit is
+// capped to maxSyncPageSize.
+func readSyncQuery(r *http.Request) (database.Hash, int, error) {
+	reqHash := r.URL.Query().Get(endpointSyncQueryKeyFromBlock)
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(reqHash))
+	if err != nil {
+		return database.Hash{}, 0, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointSyncQueryKeyFromBlock, reqHash)
+	}
+	limit := maxSyncPageSize
+	reqLimit := r.URL.Query().Get(endpointSyncQueryKeyLimit)
+	if reqLimit != "" {
+		limit, err = strconv.Atoi(reqLimit)
+		if err != nil {
+			return database.Hash{}, 0, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointSyncQueryKeyLimit, reqLimit)
+		}
+		if limit <= 0 || limit > maxSyncPageSize {
+			limit = maxSyncPageSize
+		}
+	}
+	return hash, limit, nil
+}
+
 func addPeerHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 	peerIP := r.URL.Query().Get(endpointAddPeerQueryKeyIP)
 	peerPortRaw := r.URL.Query().Get(endpointAddPeerQueryKeyPort)
 	minerRaw := r.URL.Query().Get(endpointAddPeerQueryKeyMiner)
 	peerPort, err := strconv.ParseUint(peerPortRaw, 10, 32)
 	if err != nil {
-		writeRes(w, AddPeerRes{false, err.Error()})
+		writeErrRes(w, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointAddPeerQueryKeyPort, peerPortRaw))
 		return
 	}
 
@@ -100,7 +322,232 @@ func addPeerHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 
 	node.AddPeer(peer)
 
-	fmt.Printf("Peer '%s' was added into KnownPeers\n", peer.TcpAddress())
-
 	writeRes(w, AddPeerRes{true, ""})
 }
+
+func getWorkHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	miner := r.URL.Query().Get(endpointMiningWorkQueryKeyMiner)
+	work, err := node.getWork(database.NewAccount(miner))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, work)
+}
+
+func submitWorkHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	req := SubmitWorkReq{}
+	err := readReq(r, &req)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	hash, err := node.submitWork(req)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, SubmitWorkRes{true, hash})
+}
+
+// blocksHandler serves GET /blocks?from=&limit=, blocks in ascending order
+// starting with number from.
+func blocksHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	query := r.URL.Query()
+	from := uint64(0)
+	var err error
+	if reqFrom := query.Get(endpointBlocksQueryKeyFrom); reqFrom != "" {
+		from, err = strconv.ParseUint(reqFrom, 10, 64)
+		if err != nil {
+			writeErrRes(w, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointBlocksQueryKeyFrom, reqFrom))
+			return
+		}
+	}
+	limit := defaultBlocksPageSize
+	if reqLimit := query.Get(endpointBlocksQueryKeyLimit); reqLimit != "" {
+		limit, err = strconv.Atoi(reqLimit)
+		if err != nil || limit <= 0 {
+			writeErrRes(w, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointBlocksQueryKeyLimit, reqLimit))
+			return
+		}
+		if limit > maxBlocksPageSize {
+			limit = maxBlocksPageSize
+		}
+	}
+
+	blocks, err := node.state.BlocksFrom(from, limit)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	res := BlocksRes{Blocks: make([]BlockRes, 0, len(blocks))}
+	for _, blockFs := range blocks {
+		blockRes, err := newBlockRes(blockFs)
+		if err != nil {
+			writeErrRes(w, err)
+			return
+		}
+		res.Blocks = append(res.Blocks, blockRes)
+	}
+	writeRes(w, res)
+}
+
+// blockHandler serves GET /blocks/latest, /blocks/{height} and
+// /blocks/hash/{hash}.
+func blockHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	path := strings.TrimPrefix(r.URL.Path, endpointBlocks+"/")
+	var blockFs database.BlockFS
+	var err error
+	switch {
+	case path == "latest":
+		blockFs, err = node.state.BlockByHash(node.state.LatestBlockHash())
+	case strings.HasPrefix(path, "hash/"):
+		hash := database.Hash{}
+		reqHash := strings.TrimPrefix(path, "hash/")
+		if len(reqHash) != 2*len(hash) || hash.UnmarshalText([]byte(reqHash)) != nil {
+			writeErrRes(w, fmt.Errorf("%w: invalid block hash '%s'", ErrBadRequest, reqHash))
+			return
+		}
+		blockFs, err = node.state.BlockByHash(hash)
+	default:
+		height, parseErr := strconv.ParseUint(path, 10, 64)
+		if parseErr != nil {
+			writeErrRes(w, fmt.Errorf("%w: unknown endpoint '%s'", ErrNotFound, r.URL.Path))
+			return
+		}
+		blockFs, err = node.state.BlockByNumber(height)
+	}
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	res, err := newBlockRes(blockFs)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, res)
+}
+
+func newBlockRes(blockFs database.BlockFS) (BlockRes, error) {
+	res := BlockRes{blockFs.Key, blockFs.Value.Header, make([]BlockTxRes, 0, len(blockFs.Value.Txs))}
+	for _, tx := range blockFs.Value.Txs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			return BlockRes{}, err
+		}
+		res.Txs = append(res.Txs, BlockTxRes{txHash, tx})
+	}
+	return res, nil
+}
+
+// receiptHandler serves GET /receipts/{hash}, the receipt of a TX of the
+// local chain.
+func receiptHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	reqHash := strings.TrimPrefix(r.URL.Path, endpointReceipts+"/")
+	hash := database.Hash{}
+	if len(reqHash) != 2*len(hash) || hash.UnmarshalText([]byte(reqHash)) != nil {
+		writeErrRes(w, fmt.Errorf("%w: invalid TX hash '%s'", ErrBadRequest, reqHash))
+		return
+	}
+
+	receipt, err := node.state.Receipt(hash)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, receipt)
+}
+
+// accountHistoryHandler serves GET /accounts/{account}/history?from=&limit=,
+// the receipts of the account's TXs starting with block number from. The
+// receipts of a block are never split across pages.
+func accountHistoryHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	path := strings.TrimPrefix(r.URL.Path, endpointAccounts+"/")
+	account, ok := strings.CutSuffix(path, "/history")
+	if !ok || account == "" || strings.Contains(account, "/") {
+		writeErrRes(w, fmt.Errorf("%w: unknown endpoint '%s'", ErrNotFound, r.URL.Path))
+		return
+	}
+
+	query := r.URL.Query()
+	from := uint64(0)
+	var err error
+	if reqFrom := query.Get(endpointHistoryQueryKeyFrom); reqFrom != "" {
+		from, err = strconv.ParseUint(reqFrom, 10, 64)
+		if err != nil {
+			writeErrRes(w, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointHistoryQueryKeyFrom, reqFrom))
+			return
+		}
+	}
+	limit := defaultHistoryPageSize
+	if reqLimit := query.Get(endpointHistoryQueryKeyLimit); reqLimit != "" {
+		limit, err = strconv.Atoi(reqLimit)
+		if err != nil || limit <= 0 {
+			writeErrRes(w, fmt.Errorf("%w: invalid %s '%s'", ErrBadRequest, endpointHistoryQueryKeyLimit, reqLimit))
+			return
+		}
+		if limit > maxHistoryPageSize {
+			limit = maxHistoryPageSize
+		}
+	}
+
+	res := AccountHistoryRes{Account: database.NewAccount(account)}
+	res.Receipts, err = node.state.AccountHistory(res.Account, from, limit)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	writeRes(w, res)
+}
+
+// eventsHandler streams the node events as Server-Sent Events. The types
+// query param is a comma separated list of event types, account keeps the
+// events touching that account only.
+func eventsHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrRes(w, fmt.Errorf("streaming is not supported by the connection"))
+		return
+	}
+
+	filter := EventFilter{Account: database.NewAccount(r.URL.Query().Get(endpointEventsQueryKeyAccount))}
+	if reqTypes := r.URL.Query().Get(endpointEventsQueryKeyTypes); reqTypes != "" {
+		filter.Types = make(map[string]bool)
+		for _, eventType := range strings.Split(reqTypes, ",") {
+			filter.Types[strings.TrimSpace(eventType)] = true
+		}
+	}
+
+	sub := node.events.subscribe(filter)
+	defer node.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventsHeartbeatSeconds * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				// Dropped for falling behind, the client reconnects.
+				return
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
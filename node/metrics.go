@@ -0,0 +1,85 @@
+package node
+
+import (
+	"blocks/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const endpointMetrics = "/metrics"
+
+var (
+	miningAttempts = metrics.NewCounter(
+		"tbb_mining_attempts_total",
+		"Nonces tried by the PoW miner of this process.",
+	)
+	miningHashRate = metrics.NewGauge(
+		"tbb_mining_hash_rate",
+		"Hashes per second of the last PoW mining round.",
+	)
+	// mempoolSize and peerCount are set where the node's maps change, under
+	// the lock guarding them.
+	mempoolSize = metrics.NewGauge(
+		"tbb_mempool_size",
+		"Number of pending TXs.",
+	)
+	peerCount = metrics.NewGauge(
+		"tbb_peers",
+		"Number of known peers.",
+	)
+	syncFailures = metrics.NewCounter(
+		"tbb_sync_failures_total",
+		"Failed syncs with a peer.",
+		"peer",
+	)
+	reorgs = metrics.NewCounter(
+		"tbb_reorgs_total",
+		"Switches of the local chain to a longer fork.",
+	)
+	httpRequestSeconds = metrics.NewHistogram(
+		"tbb_http_request_duration_seconds",
+		"Latency of the HTTP API by route and status.",
+		metrics.DefaultBuckets,
+		"route", "status",
+	)
+)
+
+// metricsHandler writes the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+	w.WriteHeader(http.StatusOK)
+	_, _ = metrics.Default.WriteTo(w)
+}
+
+// observeRequest records the latency and status of the requests to route.
+func observeRequest(route string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(recorder, r)
+		httpRequestSeconds.Observe(time.Since(start).Seconds(), route, strconv.Itoa(recorder.status))
+	}
+}
+
+// statusRecorder remembers the status written to a response. It passes
+// Flush through so event streams keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -2,10 +2,13 @@ package node
 
 import (
 	"blocks/database"
-	"blocks/fs"
 	"context"
 	"fmt"
+	"log/slog"
+	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,57 +19,163 @@ type PendingBlock struct {
 	number uint64
 	time   uint64
 	miner  database.Account
+	reward uint
 	txs    []database.Tx
 }
 
-func NewPendingBlock(parent database.Hash, number uint64, miner database.Account, txs []database.Tx) PendingBlock {
-	return PendingBlock{parent, number, uint64(time.Now().Unix()), miner, txs}
+// NewPendingBlock prepares a block paying reward, the block reward plus the
+// fees of txs, to the miner through its coinbase TX.
+func NewPendingBlock(parent database.Hash, number uint64, miner database.Account, reward uint, txs []database.Tx) PendingBlock {
+	return PendingBlock{parent, number, uint64(time.Now().Unix()), miner, reward, txs}
 }
 
-func Mine(ctx context.Context, pb PendingBlock) (database.Block, error) {
+// block assembles the final block, prepending the coinbase TX to the pending TXs.
+func (pb PendingBlock) block(nonce uint32, time uint64, miner database.Account) database.Block {
+	txs := make([]database.Tx, 0, len(pb.txs)+1)
+	txs = append(txs, database.NewCoinbaseTx(miner, pb.reward, time))
+	txs = append(txs, pb.txs...)
+	return database.NewBlock(pb.parent, pb.number, nonce, time, miner, txs)
+}
+
+// isBlockHashValid is the PoW target Mine searches for. Tests lower it so a
+// block is found in a few attempts.
+var isBlockHashValid = database.IsBlockHashValid
+
+// Mine searches for a valid PoW nonce using the given number of worker
+// goroutines. Every worker scans its own slice of the nonce space; the first
+// solution found cancels the others. Progress is logged to logger.
+func Mine(ctx context.Context, pb PendingBlock, threads int, logger *slog.Logger) (database.Block, error) {
 	if len(pb.txs) == 0 {
 		return database.Block{}, fmt.Errorf("mining empty block is not allowed")
 	}
+	if threads < 1 {
+		threads = 1
+	}
 	start := time.Now()
-	attempt := 0
+
+	miningCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+
+	var attempts uint64
+	// The workers have all returned by the time Mine does.
+	defer func() {
+		total := atomic.LoadUint64(&attempts)
+		miningAttempts.Add(float64(total))
+		miningHashRate.Set(hashRate(total, time.Since(start)))
+	}()
+	found := make(chan database.Block, threads)
+	failed := make(chan error, threads)
+	offset := rand.Uint32()
+
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			block, err := mineWorker(miningCtx, pb, offset+uint32(worker), uint32(threads), &attempts, start, logger)
+			if err != nil {
+				failed <- err
+				return
+			}
+			found <- block
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
 	var block database.Block
-	var hash database.Hash
-	var nonce uint32
+	select {
+	case block = <-found:
+		stopWorkers()
+		<-done
+	case <-done:
+		select {
+		case block = <-found:
+		default:
+			select {
+			case err := <-failed:
+				if ctx.Err() == nil {
+					return database.Block{}, err
+				}
+			default:
+			}
+			logger.Info("mining cancelled", "height", pb.number)
+			return database.Block{}, fmt.Errorf("mining cancelled. %s", ctx.Err())
+		}
+	}
+
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Block{}, err
+	}
+	elapsed := time.Since(start)
+	total := atomic.LoadUint64(&attempts)
+
+	logger.Info("mined new block using PoW",
+		"block", hash.Hex(),
+		"height", block.Header.Number,
+		"nonce", block.Header.Nonce,
+		"time", block.Header.Time,
+		"miner", block.Header.Miner,
+		"parent", block.Header.Parent.Hex(),
+		"attempts", total,
+		"threads", threads,
+		"hash_rate", math.Round(hashRate(total, elapsed)),
+		"elapsed", elapsed,
+	)
 
-	for !database.IsBlockHashValid(hash) {
+	return block, nil
+}
+
+// mineWorker tries the nonces first, first+step, first+2*step, ... wrapping
+// around the uint32 space. Once the worker has covered its share of the space
+// it bumps the block time so the search continues over fresh hashes.
+func mineWorker(ctx context.Context, pb PendingBlock, first uint32, step uint32, attempts *uint64, start time.Time, logger *slog.Logger) (database.Block, error) {
+	blockTime := pb.time
+	perTime := uint64(math.MaxUint32)/uint64(step) + 1
+	nonce := first
+	var tried uint64
+	// Only the nonce changes between attempts at the same block time, the
+	// block and its TX root are built once per block time.
+	block := pb.block(nonce, blockTime, pb.miner)
+
+	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("mining cancelled")
-			return database.Block{}, fmt.Errorf("mining cancelled. %s", ctx.Err())
+			return database.Block{}, ctx.Err()
 		default:
-
 		}
-		attempt++
-		nonce = generatedNonce()
-		if attempt%1000000 == 0 || attempt == 1 {
-			fmt.Printf("Mining %d Pending Txs.Attempt:%d\n", len(pb.txs), attempt)
+		if tried == perTime {
+			tried = 0
+			blockTime++
+			block = pb.block(nonce, blockTime, pb.miner)
 		}
-		block = database.NewBlock(pb.parent, pb.number, nonce, pb.time, pb.miner, pb.txs)
-		blockHash, err := block.Hash()
+
+		block.Header.Nonce = nonce
+		hash, err := block.Hash()
 		if err != nil {
 			return database.Block{}, fmt.Errorf("couldnt mine .block. %s", err.Error())
 		}
-		hash = blockHash
-	}
-	fmt.Printf("\nMined new Block '%x' using PoW🎉🎉🎉%s:\n", hash, fs.Unicode("\\U1F389"))
-	fmt.Printf("\tHeight: '%v'\n", block.Header.Number)
-	fmt.Printf("\tNonce: '%v'\n", block.Header.Nonce)
-	fmt.Printf("\tCreated: '%v'\n", block.Header.Time)
-	fmt.Printf("\tMiner: '%v'\n", block.Header.Time)
-	fmt.Printf("\tParent: '%v'\n\n", block.Header.Parent.Hex())
-
-	fmt.Printf("\tAttempt: '%v'\n", attempt)
-	fmt.Printf("\tTime: %s\n\n", time.Since(start))
-
-	return block, nil
+		if isBlockHashValid(hash) {
+			atomic.AddUint64(attempts, 1)
+			return block, nil
+		}
 
+		total := atomic.AddUint64(attempts, 1)
+		if total%1000000 == 0 || total == 1 {
+			logger.Debug("mining", "height", pb.number, "txs", len(pb.txs), "attempts", total, "hash_rate", math.Round(hashRate(total, time.Since(start))))
+		}
+		nonce += step
+		tried++
+	}
 }
-func generatedNonce() uint32 {
-	rand.Seed(time.Now().UTC().UnixNano())
-	return rand.Uint32()
+
+func hashRate(attempts uint64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(attempts) / elapsed.Seconds()
 }
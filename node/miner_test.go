@@ -0,0 +1,142 @@
+package node
+
+import (
+	"blocks/database"
+	"context"
+	"io"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func BenchmarkMine1(b *testing.B) {
+	benchmarkMine(b, 1)
+}
+
+func BenchmarkMineN(b *testing.B) {
+	benchmarkMine(b, DefaultMiningThreads)
+}
+
+// benchmarkMine measures the hash rate of Mine's workers. An op is one nonce
+// tried, so ns/op drops as workers are added, until they outnumber the
+// cores.
+func benchmarkMine(b *testing.B, threads int) {
+	pb := NewPendingBlock(database.Hash{}, 1, database.NewAccount("andrej"), database.BlockReward, []database.Tx{
+		database.NewTx("andrej", "babayaga", 1, ""),
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var attempts uint64
+	target := uint64(b.N)
+	start := time.Now()
+	b.ResetTimer()
+
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(worker int, pb PendingBlock) {
+			defer wg.Done()
+			// Finding a solution only ends the round, the next one hashes a
+			// later block time.
+			for atomic.LoadUint64(&attempts) < target && ctx.Err() == nil {
+				_, _ = mineWorker(ctx, pb, uint32(worker), uint32(threads), &attempts, start, logger)
+				pb.time++
+			}
+		}(i, pb)
+	}
+	for atomic.LoadUint64(&attempts) < target {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(hashRate(atomic.LoadUint64(&attempts), time.Since(start)), "hashes/s")
+}
+
+// withEasyTarget makes Mine accept hashes passing isValid for the duration
+// of the test.
+func withEasyTarget(t *testing.T, isValid func(database.Hash) bool) {
+	t.Helper()
+	previous := isBlockHashValid
+	isBlockHashValid = isValid
+	t.Cleanup(func() {
+		isBlockHashValid = previous
+	})
+}
+
+// waitForGoroutines fails unless the number of goroutines falls back to at
+// most want, as it does once Mine's workers have all returned.
+func waitForGoroutines(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running after Mine returned, want %d", runtime.NumGoroutine(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMineReturnsOneValidBlock(t *testing.T) {
+	withEasyTarget(t, func(hash database.Hash) bool {
+		return hash[0] == 0
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	pb := NewPendingBlock(database.Hash{1}, 2, database.NewAccount("andrej"), database.BlockReward, []database.Tx{
+		database.NewTx("andrej", "babayaga", 1, ""),
+	})
+	goroutines := runtime.NumGoroutine()
+
+	block, err := Mine(context.Background(), pb, 4, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash[0] != 0 {
+		t.Errorf("mined block hash '%s' doesn't meet the target", hash.Hex())
+	}
+	if block.Header.Parent != pb.parent || block.Header.Number != pb.number {
+		t.Errorf("mined block #%d on '%s' must be #%d on '%s'", block.Header.Number, block.Header.Parent.Hex(), pb.number, pb.parent.Hex())
+	}
+	if len(block.Txs) != 2 || !block.Txs[0].IsCoinbase() || block.Txs[0].Value != pb.reward {
+		t.Errorf("mined block must hold a coinbase paying %d and the pending TX, got %+v", pb.reward, block.Txs)
+	}
+	waitForGoroutines(t, goroutines)
+}
+
+func TestMineStopsWhenCancelled(t *testing.T) {
+	withEasyTarget(t, func(hash database.Hash) bool {
+		return false
+	})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	pb := NewPendingBlock(database.Hash{1}, 2, database.NewAccount("andrej"), database.BlockReward, []database.Tx{
+		database.NewTx("andrej", "babayaga", 1, ""),
+	})
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Mine(ctx, pb, 4, logger)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Mine must fail once cancelled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Mine didn't return within 5s of being cancelled")
+	}
+	waitForGoroutines(t, goroutines)
+}
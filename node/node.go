@@ -3,9 +3,14 @@ package node
 import (
 	"blocks/database"
 	"context"
-	"encoding/json"
+	"crypto/ed25519"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"runtime"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -15,11 +20,51 @@ const DefaultHTTPort = 8080
 const endpointStatus = "/node/status"
 const endpointSync = "/node/sync"
 const endpointSyncQueryKeyFromBlock = "fromBlock"
+const endpointSyncQueryKeyLimit = "limit"
+const endpointHeaders = "/node/headers"
+const endpointLocate = "/node/locate"
+const maxSyncPageSize = 500
 const endpointAddPeer = "/node/peer"
 const endpointAddPeerQueryKeyIP = "ip"
 const endpointAddPeerQueryKeyPort = "port"
-const miningIntervalSeconds = 10
 const endpointAddPeerQueryKeyMiner = "miner"
+const endpointMiningWork = "/mining/work"
+const endpointMiningWorkQueryKeyMiner = "miner"
+const endpointMiningSubmit = "/mining/submit"
+const endpointBlocks = "/blocks"
+const endpointRPC = "/rpc"
+const endpointEvents = "/events"
+const endpointEventsQueryKeyTypes = "types"
+const endpointEventsQueryKeyAccount = "account"
+const eventsHeartbeatSeconds = 15
+const endpointBlocksQueryKeyFrom = "from"
+const endpointBlocksQueryKeyLimit = "limit"
+const defaultBlocksPageSize = 20
+const maxBlocksPageSize = 100
+const endpointReceipts = "/receipts"
+const endpointAccounts = "/accounts"
+const endpointHistoryQueryKeyFrom = "from"
+const endpointHistoryQueryKeyLimit = "limit"
+const defaultHistoryPageSize = 20
+const maxHistoryPageSize = 100
+const endpointHealth = "/healthz"
+const endpointReady = "/readyz"
+const endpointSyncProgress = "/node/sync/progress"
+const readyMaxBlocksBehind = 5
+
+// shutdownTimeout bounds how long Run waits for in-flight HTTP requests
+// once its context is cancelled.
+const shutdownTimeout = 10 * time.Second
+
+var DefaultMiningThreads = runtime.NumCPU()
+
+const DefaultRateLimit = 20
+const DefaultRateBurst = 40
+
+// DefaultMiningInterval is how often pending TXs are checked for mining,
+// DefaultSyncInterval how often peers are asked for new blocks and peers.
+const DefaultMiningInterval = 10 * time.Second
+const DefaultSyncInterval = 45 * time.Second
 
 type PeerNode struct {
 	IP          string           `json:"ip"`
@@ -34,86 +79,358 @@ func (pn PeerNode) TcpAddress() string {
 }
 
 type Node struct {
-	dataDir         string
-	Info            PeerNode
-	state           *database.State
-	knownPeers      map[string]PeerNode
-	pendingTXs      map[string]database.Tx
-	archivedTXs     map[string]database.Tx
-	newSyncedBlocks chan database.Block
-	newPendingTXs   chan database.Tx
-	isMining        bool
-}
-
-func New(dataDir string, ip string, port uint64, acc database.Account, bootstrap PeerNode) *Node {
+	dataDir     string
+	Info        PeerNode
+	state       *database.State
+	peersMu     sync.Mutex // guards knownPeers
+	knownPeers  map[string]PeerNode
+	txsMu       sync.Mutex // guards pendingTXs and archivedTXs
+	pendingTXs  map[string]database.Tx
+	archivedTXs map[string]database.Tx
+	miningMu    sync.Mutex
+	isMining    bool
+	stopMining  context.CancelFunc
+	// miningParent is the parent of the block being sealed while isMining.
+	miningParent  database.Hash
+	miningPaused  bool // set by pauseMining while a reorg imports a fork
+	miningThreads int
+	chainMu       sync.Mutex // serializes the blocks added and rolled back
+	workMu        sync.Mutex
+	work          map[string]PendingBlock
+	signerKey     ed25519.PrivateKey
+	sealer        Sealer
+	fsync         database.FsyncPolicy
+	events        *eventBus
+	apiTokens     []string
+	rateLimiter   *rateLimiter
+	client        apiClient
+	tls           TLSConfig
+	logger        *slog.Logger
+	progress      *syncProgress
+	queuedTXs     []database.Tx
+	miningEvery   time.Duration
+	syncEvery     time.Duration
+}
+
+// Option customises a Node created by New.
+type Option func(n *Node)
+
+// WithMiningThreads sets the number of goroutines used to search for a PoW nonce.
+func WithMiningThreads(threads int) Option {
+	return func(n *Node) {
+		if threads > 0 {
+			n.miningThreads = threads
+		}
+	}
+}
+
+// WithMiningInterval sets how often the node tries to mine its pending TXs.
+func WithMiningInterval(interval time.Duration) Option {
+	return func(n *Node) {
+		if interval > 0 {
+			n.miningEvery = interval
+		}
+	}
+}
+
+// WithSyncInterval sets how often the node syncs with its peers.
+func WithSyncInterval(interval time.Duration) Option {
+	return func(n *Node) {
+		if interval > 0 {
+			n.syncEvery = interval
+		}
+	}
+}
+
+// WithSignerKey sets the key this node seals proof-of-authority blocks with.
+func WithSignerKey(key ed25519.PrivateKey) Option {
+	return func(n *Node) {
+		n.signerKey = key
+	}
+}
+
+// WithAPITokens sets the tokens granting access to the admin endpoints. The
+// first one also authenticates this node to its peers, so nodes of a
+// network usually share it. Without tokens the admin endpoints are open,
+// so Run only serves the API on a loopback IP.
+func WithAPITokens(tokens []string) Option {
+	return func(n *Node) {
+		n.apiTokens = tokens
+	}
+}
+
+// WithRateLimit limits the requests of every client IP without a valid API
+// token, or of every client IP when no token is configured, to perSecond,
+// with bursts of up to burst requests. A perSecond of 0 disables rate
+// limiting.
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(n *Node) {
+		n.rateLimiter = newRateLimiter(perSecond, burst)
+	}
+}
+
+// WithLogger sets the logger of the node and its state, slog.Default()
+// otherwise.
+func WithLogger(logger *slog.Logger) Option {
+	return func(n *Node) {
+		n.logger = logger
+	}
+}
+
+// WithFsyncPolicy sets when blocks appended to block.db are flushed to disk.
+func WithFsyncPolicy(policy database.FsyncPolicy) Option {
+	return func(n *Node) {
+		n.fsync = policy
+	}
+}
+
+// WithPendingTXs queues txs to be added to the pending pool once Run has
+// loaded the state, AddPendingTX failing before that.
+func WithPendingTXs(txs ...database.Tx) Option {
+	return func(n *Node) {
+		n.queuedTXs = append(n.queuedTXs, txs...)
+	}
+}
+
+// New creates a node knowing bootstrap as its first peer. A bootstrap
+// without IP, for the first node of a network, is ignored.
+func New(dataDir string, ip string, port uint64, acc database.Account, bootstrap PeerNode, opts ...Option) *Node {
 	knownPeers := make(map[string]PeerNode)
-	knownPeers[bootstrap.TcpAddress()] = bootstrap
-	return &Node{
-		dataDir:         dataDir,
-		Info:            NewPeerNode(ip, port, false, acc, true),
-		knownPeers:      knownPeers,
-		pendingTXs:      make(map[string]database.Tx),
-		archivedTXs:     make(map[string]database.Tx),
-		newSyncedBlocks: make(chan database.Block),
-		newPendingTXs:   make(chan database.Tx),
-		isMining:        false,
+	if bootstrap.IP != "" {
+		knownPeers[bootstrap.TcpAddress()] = bootstrap
+	}
+	n := &Node{
+		events:        newEventBus(),
+		dataDir:       dataDir,
+		Info:          NewPeerNode(ip, port, false, acc, true),
+		knownPeers:    knownPeers,
+		pendingTXs:    make(map[string]database.Tx),
+		archivedTXs:   make(map[string]database.Tx),
+		isMining:      false,
+		miningThreads: DefaultMiningThreads,
+		work:          make(map[string]PendingBlock),
+		fsync:         database.FsyncAlways,
+		logger:        slog.Default(),
+		progress:      newSyncProgress(),
+		miningEvery:   DefaultMiningInterval,
+		syncEvery:     DefaultSyncInterval,
 	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	peerCount.Set(float64(len(knownPeers)))
+	mempoolSize.Set(0)
+	return n
 }
 
 func NewPeerNode(ip string, port uint64, isBootstrap bool, acc database.Account, connected bool) PeerNode {
 	return PeerNode{ip, port, isBootstrap, acc, connected}
 }
+
+// Run loads the state, then syncs, mines and serves the HTTP API until ctx
+// is cancelled. It then drains the in-flight requests, waits for the sync
+// and mining loops to stop, saves the pending TXs and peers and flushes
+// block.db before returning.
 func (n *Node) Run(ctx context.Context) error {
-	fmt.Println(fmt.Sprintf("Listening on: %s:%d", n.Info.IP, n.Info.Port))
-	state, err := database.NewStateFromDisk(n.dataDir)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	addr, err := n.listenAddr()
+	if err != nil {
+		return err
+	}
+	state, err := database.NewStateFromDisk(n.dataDir, database.WithFsyncPolicy(n.fsync), database.WithLogger(n.logger))
 	if err != nil {
 		return err
 	}
 	defer state.Close()
 	n.state = state
-	fmt.Println("Blockchain State:")
-	fmt.Printf("-height:%d\n", n.state.LatestBlock().Header.Number)
-	fmt.Printf("-hash:%s\n", n.state.LatestBlockHash().Hex())
-	go n.sync(ctx)
-	go n.mine(ctx)
-	http.HandleFunc("/balances/list", func(w http.ResponseWriter, r *http.Request) {
-		listBalanceHandler(w, r, state)
-	})
-	http.HandleFunc("/tx/add", func(w http.ResponseWriter, r *http.Request) {
+	n.logger.Info("loaded blockchain state",
+		"height", n.state.LatestBlock().Header.Number,
+		"block", n.state.LatestBlockHash().Hex(),
+		"consensus", n.state.Engine().Name(),
+	)
+	n.loadNodeState()
+	n.addQueuedTXs()
+	n.sealer, err = n.newSealer()
+	if err != nil {
+		return err
+	}
+	peerToken := ""
+	if len(n.apiTokens) > 0 {
+		peerToken = n.apiTokens[0]
+	}
+	n.client, err = newAPIClient(peerToken, n.tls)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: n.routes(),
+		// Long lived requests such as event streams end with ctx.
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+	if n.tls.enabled() {
+		server.TLSConfig, err = n.tls.serverConfig()
+		if err != nil {
+			return err
+		}
+	}
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		n.sync(ctx)
+	}()
+	go func() {
+		defer background.Done()
+		n.mine(ctx)
+	}()
+	if len(n.apiTokens) == 0 {
+		n.logger.Warn("no API token configured, admin endpoints are open to local clients", "addr", addr)
+	}
+
+	n.logger.Info("listening", "ip", n.Info.IP, "port", n.Info.Port, "tls", n.tls.enabled())
+	serveErr := make(chan error, 1)
+	go func() {
+		if n.tls.enabled() {
+			// The certificate is already loaded into server.TLSConfig.
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-serveErr:
+		cancel()
+		background.Wait()
+		return err
+	case <-ctx.Done():
+	}
+
+	n.logger.Info("shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	err = server.Shutdown(shutdownCtx)
+	if err != nil {
+		n.logger.Warn("HTTP requests still running at shutdown were aborted", "err", err)
+		server.Close()
+	}
+	<-serveErr
+	background.Wait()
+
+	err = n.saveNodeState()
+	if err != nil {
+		return err
+	}
+	n.logger.Info("node stopped")
+	return nil
+}
+
+// routes registers the HTTP API. Admin endpoints change the node's pending
+// TXs, peers or chain and require an API token, public ones are rate
+// limited per client IP.
+func (n *Node) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	n.handle(mux, "/balances/list", accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		listBalanceHandler(w, r, n.state)
+	})
+	n.handle(mux, "/chain/supply", accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		supplyHandler(w, r, n.state)
+	})
+	n.handle(mux, "/tx/add", accessAdmin, func(w http.ResponseWriter, r *http.Request) {
 		txAddHandler(w, r, n)
 	})
-
-	http.HandleFunc(endpointStatus, func(w http.ResponseWriter, r *http.Request) {
+	n.handle(mux, endpointStatus, accessPublic, func(w http.ResponseWriter, r *http.Request) {
 		statusHandler(w, r, n)
 	})
-	http.HandleFunc(endpointSync, func(w http.ResponseWriter, r *http.Request) {
+	n.handle(mux, endpointSync, accessPublic, func(w http.ResponseWriter, r *http.Request) {
 		syncHandler(w, r, n)
 	})
-	http.HandleFunc(endpointAddPeer, func(w http.ResponseWriter, r *http.Request) {
+	n.handle(mux, endpointHeaders, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		headersHandler(w, r, n)
+	})
+	n.handle(mux, endpointLocate, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		locateHandler(w, r, n)
+	})
+	n.handle(mux, endpointAddPeer, accessAdmin, func(w http.ResponseWriter, r *http.Request) {
 		addPeerHandler(w, r, n)
 	})
-	server := &http.Server{Addr: fmt.Sprintf(":%d", n.Info.Port)}
-	go func() {
-		<-ctx.Done()
-		_ = server.Close()
-	}()
-	err = server.ListenAndServe()
-	// This shouldn't be an error!
-	if err != http.ErrServerClosed {
-		return err
-	}
-
-	return nil
+	n.handle(mux, endpointBlocks, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		blocksHandler(w, r, n)
+	})
+	n.handle(mux, endpointBlocks+"/", accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		blockHandler(w, r, n)
+	})
+	n.handle(mux, endpointReceipts+"/", accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		receiptHandler(w, r, n)
+	})
+	n.handle(mux, endpointAccounts+"/", accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		accountHistoryHandler(w, r, n)
+	})
+	n.handle(mux, endpointEvents, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		eventsHandler(w, r, n)
+	})
+	// RPC methods check their own access, see rpcMethods.
+	n.handle(mux, endpointRPC, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		rpcHandler(w, r, n)
+	})
+	n.handle(mux, endpointMiningWork, accessAdmin, func(w http.ResponseWriter, r *http.Request) {
+		getWorkHandler(w, r, n)
+	})
+	n.handle(mux, endpointMiningSubmit, accessAdmin, func(w http.ResponseWriter, r *http.Request) {
+		submitWorkHandler(w, r, n)
+	})
+	n.handle(mux, endpointMetrics, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(w, r, n)
+	})
+	n.handle(mux, endpointHealth, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		healthHandler(w, r, n)
+	})
+	n.handle(mux, endpointReady, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		readyHandler(w, r, n)
+	})
+	n.handle(mux, endpointSyncProgress, accessPublic, func(w http.ResponseWriter, r *http.Request) {
+		syncProgressHandler(w, r, n)
+	})
+	return mux
 }
+
+// LatestBlockHash is the hash of the chain tip, empty until Run has loaded
+// the state.
 func (n *Node) LatestBlockHash() database.Hash {
+	if n.state == nil {
+		return database.Hash{}
+	}
 	return n.state.LatestBlockHash()
 }
 func (n *Node) AddPeer(peer PeerNode) {
+	n.peersMu.Lock()
+	_, isKnownPeer := n.knownPeers[peer.TcpAddress()]
 	n.knownPeers[peer.TcpAddress()] = peer
+	peerCount.Set(float64(len(n.knownPeers)))
+	n.peersMu.Unlock()
+	if !isKnownPeer {
+		n.logger.Info("added peer", "peer", peer.TcpAddress())
+		n.events.publish(EventPeerConnected, peer)
+	}
 }
 
 func (n *Node) RemovePeer(peer PeerNode) {
+	n.peersMu.Lock()
+	_, isKnownPeer := n.knownPeers[peer.TcpAddress()]
 	delete(n.knownPeers, peer.TcpAddress())
+	peerCount.Set(float64(len(n.knownPeers)))
+	n.peersMu.Unlock()
+	if isKnownPeer {
+		syncFailures.Delete(peer.TcpAddress())
+		n.progress.forgetPeer(peer)
+		n.logger.Info("removed peer", "peer", peer.TcpAddress())
+		n.events.publish(EventPeerDisconnected, peer)
+	}
 }
 
 func (n *Node) IsKnownPeer(peer PeerNode) bool {
@@ -121,103 +438,311 @@ func (n *Node) IsKnownPeer(peer PeerNode) bool {
 		return true
 	}
 
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
 	_, isKnownPeer := n.knownPeers[peer.TcpAddress()]
 
 	return isKnownPeer
 }
 
+// getKnownPeers returns a copy of the known peers, safe to range over while
+// peers are added and removed.
+func (n *Node) getKnownPeers() map[string]PeerNode {
+	n.peersMu.Lock()
+	defer n.peersMu.Unlock()
+	peers := make(map[string]PeerNode, len(n.knownPeers))
+	for address, peer := range n.knownPeers {
+		peers[address] = peer
+	}
+	return peers
+}
+
+// mine seals a block out of the pending TXs every mining interval. Chains
+// sealing empty blocks, see sealsEmptyBlocks, start on the next block as
+// soon as the tip moves instead.
 func (n *Node) mine(ctx context.Context) error {
-	var miningCtx context.Context
-	var stopCurrentMining context.CancelFunc
-	ticker := time.NewTimer(time.Second * miningIntervalSeconds)
+	ticker := time.NewTicker(n.miningEvery)
+	defer ticker.Stop()
+	var mining sync.WaitGroup
+	defer mining.Wait()
+	roundDone := make(chan struct{}, 1)
+	blocks := n.events.subscribe(EventFilter{Types: map[string]bool{EventBlock: true}})
+	defer func() {
+		n.events.unsubscribe(blocks)
+	}()
 	for {
 		select {
 		case <-ticker.C:
-			go func() {
-				if len(n.pendingTXs) > 0 && !n.isMining {
-					n.isMining = true
-					miningCtx, stopCurrentMining = context.WithCancel(ctx)
-					err := n.minePendingTXs(miningCtx)
-					if err != nil {
-						fmt.Printf("ERROR:%s\n", err)
-					}
-					n.isMining = false
-				}
-			}()
-		case block, _ := <-n.newSyncedBlocks:
-			if n.isMining {
-				blockHash, _ := block.Hash()
-				fmt.Printf("\nPeer mined next Block '%s' faster:(\n", blockHash.Hex())
-				n.removeMinedPendingTXs(block)
-				stopCurrentMining()
+			n.startMining(ctx, &mining, roundDone)
+		case <-roundDone:
+			if n.sealsEmptyBlocks() {
+				n.startMining(ctx, &mining, roundDone)
+			}
+		case event, ok := <-blocks.events:
+			if !ok {
+				blocks = n.events.subscribe(EventFilter{Types: map[string]bool{EventBlock: true}})
+				continue
+			}
+			// Any block on top of the parent being sealed on, a peer's or one
+			// submitted by an external miner, makes the block being sealed
+			// stale.
+			block := event.Data.(BlockRes)
+			n.miningMu.Lock()
+			if n.isMining && block.Header.Parent == n.miningParent {
+				n.logger.Info("another block took the height being sealed", "block", block.Hash.Hex(), "height", block.Header.Number, "miner", block.Header.Miner)
+				n.stopMining()
+			}
+			n.miningMu.Unlock()
+			if n.sealsEmptyBlocks() {
+				n.startMining(ctx, &mining, roundDone)
 			}
 		case <-ctx.Done():
-			ticker.Stop()
 			return nil
-
 		}
 	}
 }
 
+// startMining seals the next block in the background unless one is already
+// being sealed. roundDone is signalled once the block is sealed, or once
+// sealing is stopped in favour of a newer tip.
+func (n *Node) startMining(ctx context.Context, mining *sync.WaitGroup, roundDone chan<- struct{}) {
+	if n.sealer == nil || (!n.hasPendingTXs() && !n.sealsEmptyBlocks()) {
+		return
+	}
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+	if n.isMining || n.miningPaused {
+		return
+	}
+	miningCtx, stopMining := context.WithCancel(ctx)
+	n.isMining = true
+	n.stopMining = stopMining
+
+	mining.Add(1)
+	go func() {
+		defer mining.Done()
+		err := n.minePendingTXs(miningCtx)
+		stopped := miningCtx.Err() != nil
+		stopMining()
+		if err != nil && !stopped {
+			n.logger.Error("sealing block failed", "err", err)
+		}
+
+		n.miningMu.Lock()
+		n.isMining = false
+		n.miningMu.Unlock()
+		if err == nil || (stopped && ctx.Err() == nil) {
+			select {
+			case roundDone <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// sealsEmptyBlocks reports whether blocks are sealed on schedule even
+// without pending TXs, as proof-of-authority chains with a period are.
+func (n *Node) sealsEmptyBlocks() bool {
+	poa, ok := n.state.Engine().(*database.PoA)
+	return ok && poa.Period() > 0
+}
+
 func (n *Node) minePendingTXs(ctx context.Context) error {
-	blockToMine := NewPendingBlock(
-		n.state.LatestBlockHash(),
-		n.state.LatestBlock().Header.Number+1,
-		n.Info.Account,
-		n.getPendingTXsAsArray(),
-	)
-	minedBlock, err := Mine(ctx, blockToMine)
+	blockToMine, err := n.newPendingBlock(n.Info.Account, n.getPendingTXsAsArray())
 	if err != nil {
 		return err
 	}
-	n.removeMinedPendingTXs(minedBlock)
-	_, err = n.state.AddBlock(minedBlock)
+	n.setMiningParent(blockToMine.parent)
+	minedBlock, err := n.sealer.Seal(ctx, blockToMine)
+	if err != nil {
+		return err
+	}
+
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	// Sealing is stopped when the tip moves, by a peer's block or a reorg.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hash, err := n.state.AddBlock(minedBlock)
 	if err != nil {
 		return err
 	}
+	n.removeMinedPendingTXs(minedBlock)
+	// The block just sealed must not stop the round that sealed it.
+	n.setMiningParent(hash)
+	n.publishBlock(minedBlock, hash)
 	return nil
+}
 
+// pauseMining stops the block being sealed and keeps new rounds from
+// starting until resume is called.
+func (n *Node) pauseMining() (resume func()) {
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+	n.miningPaused = true
+	if n.isMining {
+		n.stopMining()
+	}
+	return func() {
+		n.miningMu.Lock()
+		defer n.miningMu.Unlock()
+		n.miningPaused = false
+	}
 }
 
-func (n *Node) removeMinedPendingTXs(block database.Block) {
-	if len(block.Txs) > 0 && len(n.pendingTXs) > 0 {
-		fmt.Println("updating in memory pending TXs pool")
+func (n *Node) setMiningParent(parent database.Hash) {
+	n.miningMu.Lock()
+	defer n.miningMu.Unlock()
+	n.miningParent = parent
+}
+
+// newPendingBlock prepares the next block on top of the current tip,
+// rewarding the miner according to the monetary policy plus the TXs fees.
+func (n *Node) newPendingBlock(miner database.Account, txs []database.Tx) (PendingBlock, error) {
+	reward := n.state.NextBlockReward()
+	for _, tx := range txs {
+		var ok bool
+		reward, ok = database.AddAmounts(reward, tx.Fee)
+		if !ok {
+			return PendingBlock{}, fmt.Errorf("%w: block reward plus fees overflows", database.ErrInvalidTx)
+		}
 	}
+	return NewPendingBlock(
+		n.state.LatestBlockHash(),
+		n.state.LatestBlock().Header.Number+1,
+		miner,
+		reward,
+		txs,
+	), nil
+}
+
+func (n *Node) removeMinedPendingTXs(block database.Block) {
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
+	defer func() {
+		mempoolSize.Set(float64(len(n.pendingTXs)))
+	}()
 	for _, tx := range block.Txs {
 		txHash, _ := tx.Hash()
 		if _, exists := n.pendingTXs[txHash.Hex()]; exists {
-			fmt.Printf("\t-archiving mined TX:%s\n", txHash.Hex())
+			n.logger.Debug("archived mined TX", "tx", txHash.Hex())
 			n.archivedTXs[txHash.Hex()] = tx
 			delete(n.pendingTXs, txHash.Hex())
 		}
 	}
 }
 
+// AddPendingTX adds tx to the pending pool. It fails with ErrConflict for a
+// TX already pending or mined, with database.ErrInsufficientBalance when
+// the sender can't pay for it on top of its other pending TXs and with
+// ErrUnavailable until Run has loaded the state, see WithPendingTXs.
 func (n *Node) AddPendingTX(tx database.Tx, fromPeer PeerNode) error {
+	if n.state == nil {
+		return fmt.Errorf("%w: the state isn't loaded yet", ErrUnavailable)
+	}
+	if tx.From == "" || tx.IsReward() {
+		return fmt.Errorf("%w: reward TXs are only issued by the coinbase of a block", database.ErrInvalidTx)
+	}
 	txHash, err := tx.Hash()
 	if err != nil {
 		return err
 	}
-	txJson, err := json.Marshal(tx)
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
+	_, isAlreadyPending := n.pendingTXs[txHash.Hex()]
+	_, isArchived := n.archivedTXs[txHash.Hex()]
+	if isAlreadyPending || isArchived {
+		return fmt.Errorf("%w: TX '%s' is already known", ErrConflict, txHash.Hex())
+	}
+	pendingCost, err := tx.Cost()
 	if err != nil {
 		return err
 	}
-	_, isAlreadyPending := n.pendingTXs[txHash.Hex()]
-	_, isArchived := n.archivedTXs[txHash.Hex()]
-	if !isAlreadyPending && !isArchived {
-		fmt.Printf("Added Pending TX %s\n", txJson, fromPeer.TcpAddress())
-		n.pendingTXs[txHash.Hex()] = tx
-		n.newPendingTXs <- tx
+	for _, pendingTx := range n.pendingTXs {
+		if pendingTx.From != tx.From {
+			continue
+		}
+		cost, err := pendingTx.Cost()
+		if err != nil {
+			return err
+		}
+		var ok bool
+		pendingCost, ok = database.AddAmounts(pendingCost, cost)
+		if !ok {
+			return fmt.Errorf("%w: pending TXs of sender '%s' cost more than any balance", database.ErrInsufficientBalance, tx.From)
+		}
+	}
+	if balance := n.state.Balance(tx.From); pendingCost > balance {
+		return fmt.Errorf("%w: sender '%s' balance is %d TBB, pending TXs cost %d TBB", database.ErrInsufficientBalance, tx.From, balance, pendingCost)
 	}
+
+	n.logger.Info("added pending TX", "tx", txHash.Hex(), "from", tx.From, "to", tx.To, "value", tx.Value, "peer", fromPeer.TcpAddress())
+	n.pendingTXs[txHash.Hex()] = tx
+	mempoolSize.Set(float64(len(n.pendingTXs)))
+	n.events.publish(EventPendingTx, BlockTxRes{txHash, tx}, tx.From, tx.To)
 	return nil
 }
 
+// addQueuedTXs adds the TXs given to WithPendingTXs to the pending pool.
+func (n *Node) addQueuedTXs() {
+	for _, tx := range n.queuedTXs {
+		err := n.AddPendingTX(tx, n.Info)
+		if err != nil {
+			n.logger.Warn("dropped queued TX", "from", tx.From, "to", tx.To, "value", tx.Value, "err", err)
+		}
+	}
+	n.queuedTXs = nil
+}
+
+// addTx adds a TX submitted by a client of this node to the pending pool.
+func (n *Node) addTx(req TxAddReq) (TxAddRes, error) {
+	tx := database.NewTx(database.NewAccount(req.From), database.NewAccount(req.To), req.Value, req.Data)
+	tx.Fee = req.Fee
+	hash, err := tx.Hash()
+	if err != nil {
+		return TxAddRes{}, err
+	}
+	err = n.AddPendingTX(tx, n.Info)
+	if err != nil {
+		return TxAddRes{}, err
+	}
+	return TxAddRes{true, hash}, nil
+}
+
+func (n *Node) status() StatusRes {
+	return StatusRes{
+		Hash:       n.state.LatestBlockHash(),
+		Number:     n.state.LatestBlock().Header.Number,
+		KnownPeers: n.getKnownPeers(),
+		PendingTXs: n.getPendingTXsAsArray(),
+	}
+}
+
 func (n *Node) getPendingTXsAsArray() []database.Tx {
+	n.txsMu.Lock()
 	txs := make([]database.Tx, len(n.pendingTXs))
 	i := 0
 	for _, tx := range n.pendingTXs {
 		txs[i] = tx
 		i++
 	}
+	n.txsMu.Unlock()
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].Time < txs[j].Time
+	})
 	return txs
 }
+
+func (n *Node) hasPendingTXs() bool {
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
+	return len(n.pendingTXs) > 0
+}
+
+func (n *Node) getPendingTX(txHash database.Hash) (database.Tx, bool) {
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
+	tx, isPending := n.pendingTXs[txHash.Hex()]
+	return tx, isPending
+}
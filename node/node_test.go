@@ -0,0 +1,79 @@
+package node
+
+import (
+	"blocks/database"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// freePort returns a port nothing listens on at the time of the call.
+func freePort(t *testing.T) uint64 {
+	t.Helper()
+	listener, err := net.Listen("tcp", DefaultIP+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return uint64(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestRunStopsCleanlyWhenCancelled(t *testing.T) {
+	dataDir := t.TempDir()
+	port := freePort(t)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	n := New(dataDir, DefaultIP, port, database.NewAccount("andrej"), PeerNode{}, WithLogger(logger))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- n.Run(ctx)
+	}()
+
+	// Wait for the API so the node is fully up when it is cancelled.
+	healthURL := fmt.Sprintf("http://%s:%d%s", DefaultIP, port, endpointHealth)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := http.Get(healthURL)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Run returned before being cancelled: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the node didn't serve its API in time")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run must return nil once cancelled, got: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return within 5s of being cancelled")
+	}
+
+	for _, file := range []string{mempoolFile, peersFile} {
+		_, err := os.Stat(filepath.Join(dataDir, file))
+		if err != nil {
+			t.Errorf("%s must be saved on shutdown: %s", file, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package node
+
+import (
+	"blocks/database"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Files of the data dir keeping what only lives in memory while the node
+// runs, written on shutdown and read back on the next start.
+const (
+	mempoolFile = "mempool.json"
+	peersFile   = "peers.json"
+)
+
+// saveNodeState writes the pending TXs and the known peers to the data dir.
+func (n *Node) saveNodeState() error {
+	txs := n.getPendingTXsAsArray()
+	err := writeJsonFile(filepath.Join(n.dataDir, mempoolFile), txs)
+	if err != nil {
+		return err
+	}
+	knownPeers := n.getKnownPeers()
+	peers := make([]PeerNode, 0, len(knownPeers))
+	for _, peer := range knownPeers {
+		if peer.IP == n.Info.IP && peer.Port == n.Info.Port {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	err = writeJsonFile(filepath.Join(n.dataDir, peersFile), peers)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("saved pending TXs and peers", "txs", len(txs), "peers", len(peers))
+	return nil
+}
+
+// loadNodeState restores what saveNodeState wrote. TXs mined or no longer
+// affordable since are dropped, peers are joined again on the next sync.
+func (n *Node) loadNodeState() {
+	txs := make([]database.Tx, 0)
+	err := readJsonFile(filepath.Join(n.dataDir, mempoolFile), &txs)
+	if err != nil {
+		n.logger.Warn("unable to restore pending TXs", "err", err)
+	}
+	for _, tx := range txs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			continue
+		}
+		if _, _, err := n.state.TxByHash(txHash); err == nil {
+			continue
+		}
+		err = n.AddPendingTX(tx, n.Info)
+		if err != nil {
+			n.logger.Debug("dropped restored pending TX", "tx", txHash.Hex(), "err", err)
+		}
+	}
+
+	peers := make([]PeerNode, 0)
+	err = readJsonFile(filepath.Join(n.dataDir, peersFile), &peers)
+	if err != nil {
+		n.logger.Warn("unable to restore peers", "err", err)
+	}
+	for _, peer := range peers {
+		if !n.IsKnownPeer(peer) {
+			n.AddPeer(peer)
+		}
+	}
+}
+
+// writeJsonFile replaces path atomically, a crash mid-write leaves the
+// previous version in place.
+func writeJsonFile(path string, content interface{}) error {
+	contentJson, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contentJson)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readJsonFile leaves content untouched when path doesn't exist.
+func readJsonFile(path string, content interface{}) error {
+	contentJson, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(contentJson, content)
+}
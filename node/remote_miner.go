@@ -0,0 +1,103 @@
+package node
+
+import (
+	"blocks/database"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const remoteMinerPollInterval = 5 * time.Second
+
+// RunRemoteMiner turns this process into a standalone miner for the node at
+// nodeURL: it fetches work, searches for the nonce locally and submits the
+// solution back, until ctx is cancelled. The API token of config
+// authenticates the miner to the admin only work API, its TLS files are
+// needed for https node URLs of nodes with their own CA or mutual TLS.
+func RunRemoteMiner(ctx context.Context, nodeURL string, config ClientConfig, miner database.Account, threads int) error {
+	nodeURL = strings.TrimSuffix(nodeURL, "/")
+	client, err := newAPIClient(config.APIToken, config.TLS)
+	if err != nil {
+		return err
+	}
+	for {
+		work, err := fetchWork(client, nodeURL, miner)
+		if err != nil {
+			slog.Error("fetching work failed", "node", nodeURL, "err", err)
+			if !waitOrDone(ctx, remoteMinerPollInterval) {
+				return nil
+			}
+			continue
+		}
+		if work.ID == "" {
+			if !waitOrDone(ctx, remoteMinerPollInterval) {
+				return nil
+			}
+			continue
+		}
+
+		slog.Info("received work", "work", work.ID, "height", work.Number, "node", nodeURL)
+		pb := PendingBlock{work.Parent, work.Number, work.Time, work.Miner, work.Reward, work.Txs}
+		miningCtx, stopMining := context.WithCancel(ctx)
+		go watchTip(miningCtx, stopMining, client, nodeURL, work.Parent)
+		block, err := Mine(miningCtx, pb, threads, slog.Default())
+		stopMining()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.Error("mining failed", "work", work.ID, "err", err)
+			continue
+		}
+
+		res, err := submitWork(client, nodeURL, SubmitWorkReq{work.ID, block.Header.Nonce, block.Header.Time})
+		if err != nil {
+			slog.Error("submitting work failed", "work", work.ID, "err", err)
+			continue
+		}
+		slog.Info("node accepted block", "block", res.Hash.Hex(), "height", work.Number)
+	}
+}
+
+// watchTip cancels the current mining round as soon as the node reports a
+// different chain tip than the one the work was built on.
+func watchTip(ctx context.Context, stopMining context.CancelFunc, client apiClient, nodeURL string, parent database.Hash) {
+	for waitOrDone(ctx, remoteMinerPollInterval) {
+		status := StatusRes{}
+		err := client.getJson(nodeURL+endpointStatus, &status)
+		if err != nil {
+			continue
+		}
+		if status.Hash != parent {
+			slog.Info("chain tip moved, abandoning work", "block", status.Hash.Hex(), "height", status.Number)
+			stopMining()
+			return
+		}
+	}
+}
+
+func fetchWork(client apiClient, nodeURL string, miner database.Account) (WorkRes, error) {
+	query := url.Values{}
+	query.Set(endpointMiningWorkQueryKeyMiner, string(miner))
+	work := WorkRes{}
+	err := client.getJson(fmt.Sprintf("%s%s?%s", nodeURL, endpointMiningWork, query.Encode()), &work)
+	return work, err
+}
+
+func submitWork(client apiClient, nodeURL string, req SubmitWorkReq) (SubmitWorkRes, error) {
+	submitRes := SubmitWorkRes{}
+	err := client.postJson(nodeURL+endpointMiningSubmit, req, &submitRes)
+	return submitRes, err
+}
+
+func waitOrDone(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
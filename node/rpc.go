@@ -0,0 +1,314 @@
+package node
+
+import (
+	"blocks/database"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+)
+
+const rpcVersion = "2.0"
+
+// JSON-RPC 2.0 error codes. The -32000 to -32099 range is left to the
+// application by the spec.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcRejected       = -32000
+	rpcNotFound       = -32001
+	rpcUnauthorized   = -32002
+)
+
+type RPCReq struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// ID is nil for notifications, which get no response.
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+type RPCRes struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type RPCGetBlockParams struct {
+	Number *uint64        `json:"number"`
+	Hash   *database.Hash `json:"hash"`
+}
+
+type RPCGetTxParams struct {
+	Hash database.Hash `json:"hash"`
+}
+
+type RPCGetAccountHistoryParams struct {
+	Account database.Account `json:"account"`
+	From    uint64           `json:"from"`
+	Limit   int              `json:"limit"`
+}
+
+type RPCTxRes struct {
+	Hash        database.Hash `json:"hash"`
+	Tx          database.Tx   `json:"tx"`
+	Pending     bool          `json:"pending"`
+	BlockHash   database.Hash `json:"block_hash"`
+	BlockNumber uint64        `json:"block_number"`
+}
+
+type RPCPeersRes struct {
+	Peers []PeerNode `json:"peers"`
+}
+
+type rpcMethod struct {
+	call   func(node *Node, params json.RawMessage) (interface{}, error)
+	access access
+}
+
+// rpcMethods share the logic of the REST handlers, their results have the
+// same shape as the matching REST responses. Admin methods require an API
+// token like their REST counterparts.
+var rpcMethods = map[string]rpcMethod{
+	"tbb_getBalances":       {rpcGetBalances, accessPublic},
+	"tbb_getStatus":         {rpcGetStatus, accessPublic},
+	"tbb_sendTransaction":   {rpcSendTransaction, accessAdmin},
+	"tbb_getBlock":          {rpcGetBlock, accessPublic},
+	"tbb_getTransaction":    {rpcGetTransaction, accessPublic},
+	"tbb_getPeers":          {rpcGetPeers, accessPublic},
+	"tbb_getReceipt":        {rpcGetReceipt, accessPublic},
+	"tbb_getAccountHistory": {rpcGetAccountHistory, accessPublic},
+}
+
+// rpcHandler serves JSON-RPC 2.0 requests, single or batched, over POST.
+func rpcHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeErrRes(w, fmt.Errorf("%w: JSON-RPC requests must be POSTed", ErrMethodNotAllowed))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+	defer r.Body.Close()
+
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		err = json.Unmarshal(body, &batch)
+		if err != nil {
+			writeRes(w, newRPCErrRes(nil, rpcParseError, err.Error()))
+			return
+		}
+		if len(batch) == 0 {
+			writeRes(w, newRPCErrRes(nil, rpcInvalidRequest, "empty batch"))
+			return
+		}
+		responses := make([]RPCRes, 0, len(batch))
+		for _, rawReq := range batch {
+			if res, ok := handleRPCReq(node, rawReq, isAdminReq(r)); ok {
+				responses = append(responses, res)
+			}
+		}
+		writeRPCRes(w, responses, len(responses) > 0)
+		return
+	}
+
+	res, ok := handleRPCReq(node, body, isAdminReq(r))
+	writeRPCRes(w, res, ok)
+}
+
+// handleRPCReq runs a single request. ok is false for notifications.
+func handleRPCReq(node *Node, rawReq json.RawMessage, admin bool) (res RPCRes, ok bool) {
+	if !json.Valid(rawReq) {
+		return newRPCErrRes(nil, rpcParseError, "invalid JSON"), true
+	}
+	req := RPCReq{}
+	err := json.Unmarshal(rawReq, &req)
+	if err != nil || req.JSONRPC != rpcVersion || req.Method == "" {
+		return newRPCErrRes(req.ID, rpcInvalidRequest, "invalid JSON-RPC 2.0 request"), true
+	}
+
+	method, exists := rpcMethods[req.Method]
+	if !exists {
+		res = newRPCErrRes(req.ID, rpcMethodNotFound, fmt.Sprintf("method '%s' not found", req.Method))
+	} else if method.access == accessAdmin && !admin {
+		res = newRPCErrRes(req.ID, rpcUnauthorized, fmt.Sprintf("method '%s' requires an API token", req.Method))
+	} else if result, err := method.call(node, req.Params); err != nil {
+		res = RPCRes{JSONRPC: rpcVersion, Error: toRPCError(err), ID: req.ID}
+	} else {
+		res = RPCRes{JSONRPC: rpcVersion, Result: result, ID: req.ID}
+	}
+	return res, req.ID != nil
+}
+
+func newRPCErrRes(id json.RawMessage, code int, message string) RPCRes {
+	return RPCRes{JSONRPC: rpcVersion, Error: &RPCError{code, message}, ID: id}
+}
+
+func toRPCError(err error) *RPCError {
+	var rpcErr *RPCError
+	switch {
+	case errors.As(err, &rpcErr):
+		return rpcErr
+	case errors.Is(err, database.ErrBlockNotFound), errors.Is(err, database.ErrTxNotFound):
+		return &RPCError{rpcNotFound, err.Error()}
+	default:
+		return &RPCError{rpcInternalError, err.Error()}
+	}
+}
+
+// writeRPCRes writes content, or nothing at all when the request was made
+// of notifications only.
+func writeRPCRes(w http.ResponseWriter, content interface{}, hasContent bool) {
+	if !hasContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeRes(w, content)
+}
+
+func readRPCParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &RPCError{rpcInvalidParams, fmt.Sprintf("params must be an object: %s", err)}
+	}
+	return nil
+}
+
+func rpcGetBalances(node *Node, params json.RawMessage) (interface{}, error) {
+	hash, balances := node.state.Balances()
+	return BalanceRes{hash, balances}, nil
+}
+
+func rpcGetStatus(node *Node, params json.RawMessage) (interface{}, error) {
+	return node.status(), nil
+}
+
+func rpcSendTransaction(node *Node, params json.RawMessage) (interface{}, error) {
+	req := TxAddReq{}
+	err := readRPCParams(params, &req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := node.addTx(req)
+	if err != nil {
+		return nil, &RPCError{rpcRejected, err.Error()}
+	}
+	return res, nil
+}
+
+// rpcGetBlock looks a block up by number or hash, or returns the latest
+// block without params.
+func rpcGetBlock(node *Node, params json.RawMessage) (interface{}, error) {
+	req := RPCGetBlockParams{}
+	err := readRPCParams(params, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockFs database.BlockFS
+	switch {
+	case req.Number != nil && req.Hash != nil:
+		return nil, &RPCError{rpcInvalidParams, "pass either number or hash, not both"}
+	case req.Number != nil:
+		blockFs, err = node.state.BlockByNumber(*req.Number)
+	case req.Hash != nil:
+		blockFs, err = node.state.BlockByHash(*req.Hash)
+	default:
+		blockFs, err = node.state.BlockByHash(node.state.LatestBlockHash())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newBlockRes(blockFs)
+}
+
+// rpcGetTransaction looks a TX up in the pending pool, then in the chain.
+func rpcGetTransaction(node *Node, params json.RawMessage) (interface{}, error) {
+	req := RPCGetTxParams{}
+	err := readRPCParams(params, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Hash.IsEmpty() {
+		return nil, &RPCError{rpcInvalidParams, "missing TX hash"}
+	}
+
+	if tx, isPending := node.getPendingTX(req.Hash); isPending {
+		return RPCTxRes{Hash: req.Hash, Tx: tx, Pending: true}, nil
+	}
+	tx, blockFs, err := node.state.TxByHash(req.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return RPCTxRes{req.Hash, tx, false, blockFs.Key, blockFs.Value.Header.Number}, nil
+}
+
+func rpcGetPeers(node *Node, params json.RawMessage) (interface{}, error) {
+	knownPeers := node.getKnownPeers()
+	res := RPCPeersRes{Peers: make([]PeerNode, 0, len(knownPeers))}
+	for _, peer := range knownPeers {
+		res.Peers = append(res.Peers, peer)
+	}
+	sort.Slice(res.Peers, func(i, j int) bool {
+		return res.Peers[i].TcpAddress() < res.Peers[j].TcpAddress()
+	})
+	return res, nil
+}
+
+func rpcGetReceipt(node *Node, params json.RawMessage) (interface{}, error) {
+	req := RPCGetTxParams{}
+	err := readRPCParams(params, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Hash.IsEmpty() {
+		return nil, &RPCError{rpcInvalidParams, "missing TX hash"}
+	}
+	return node.state.Receipt(req.Hash)
+}
+
+func rpcGetAccountHistory(node *Node, params json.RawMessage) (interface{}, error) {
+	req := RPCGetAccountHistoryParams{}
+	err := readRPCParams(params, &req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Account == "" {
+		return nil, &RPCError{rpcInvalidParams, "missing account"}
+	}
+	if req.Limit <= 0 {
+		req.Limit = defaultHistoryPageSize
+	}
+	if req.Limit > maxHistoryPageSize {
+		req.Limit = maxHistoryPageSize
+	}
+
+	receipts, err := node.state.AccountHistory(req.Account, req.From, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	return AccountHistoryRes{req.Account, receipts}, nil
+}
@@ -0,0 +1,103 @@
+package node
+
+import (
+	"blocks/database"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Sealer turns a pending block into a block accepted by the chain's
+// consensus engine.
+type Sealer interface {
+	Seal(ctx context.Context, pb PendingBlock) (database.Block, error)
+}
+
+// powSealer mines the block.
+type powSealer struct {
+	threads int
+	logger  *slog.Logger
+}
+
+func (s powSealer) Seal(ctx context.Context, pb PendingBlock) (database.Block, error) {
+	return Mine(ctx, pb, s.threads, s.logger)
+}
+
+// poaSealer signs the block once the seal delay of this node's signer has
+// passed since the parent block, see database.PoA.SealDelay. Blocks are
+// sealed even without TXs so the chain advances every period.
+type poaSealer struct {
+	engine *database.PoA
+	state  *database.State
+	signer database.Signer
+	key    ed25519.PrivateKey
+	logger *slog.Logger
+}
+
+func (s poaSealer) Seal(ctx context.Context, pb PendingBlock) (database.Block, error) {
+	delay, ok := s.engine.SealDelay(pb.number, s.signer.Account)
+	if !ok {
+		return database.Block{}, fmt.Errorf("'%s' is not a signer", s.signer.Account)
+	}
+
+	blockTime := uint64(time.Now().Unix())
+	if !pb.parent.IsEmpty() {
+		parent, err := s.state.BlockByHash(pb.parent)
+		if err != nil {
+			return database.Block{}, err
+		}
+		sealAt := parent.Value.Header.Time + delay
+		select {
+		case <-ctx.Done():
+			return database.Block{}, fmt.Errorf("sealing cancelled. %s", ctx.Err())
+		case <-time.After(time.Until(time.Unix(int64(sealAt), 0))):
+		}
+		blockTime = uint64(time.Now().Unix())
+		if blockTime < sealAt {
+			blockTime = sealAt
+		}
+	}
+
+	block, err := database.SignBlock(pb.block(0, blockTime, s.signer.Account), s.key)
+	if err != nil {
+		return database.Block{}, err
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Block{}, err
+	}
+	s.logger.Info("sealed new block using PoA",
+		"block", hash.Hex(),
+		"height", block.Header.Number,
+		"signer", block.Header.Miner,
+		"parent", block.Header.Parent.Hex(),
+		"txs", len(pb.txs),
+		"in_turn", delay == s.engine.Period(),
+	)
+
+	return block, nil
+}
+
+// newSealer picks the sealer matching the chain's consensus engine. It
+// returns a nil Sealer when this node can't produce blocks.
+func (n *Node) newSealer() (Sealer, error) {
+	switch engine := n.state.Engine().(type) {
+	case database.PoW:
+		return powSealer{n.miningThreads, n.logger}, nil
+	case *database.PoA:
+		if n.signerKey == nil {
+			n.logger.Info("no signer key configured, sealing blocks is disabled")
+			return nil, nil
+		}
+		signer, ok := engine.SignerOf(n.signerKey.Public().(ed25519.PublicKey))
+		if !ok {
+			return nil, fmt.Errorf("signer key is not part of the genesis signer set")
+		}
+		n.logger.Info("sealing blocks as PoA signer", "signer", signer.Account)
+		return poaSealer{engine, n.state, signer, n.signerKey, n.logger}, nil
+	default:
+		return nil, fmt.Errorf("no sealer for consensus engine '%s'", engine.Name())
+	}
+}
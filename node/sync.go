@@ -3,66 +3,84 @@ package node
 import (
 	"blocks/database"
 	"context"
+	"errors"
 	"fmt"
-	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
 	"time"
 )
 
-func (n *Node) sync(ctx context.Context) error {
-	ticker := time.NewTicker(45 * time.Second)
+const syncHeadersPageSize = 500
+const syncBlocksPageSize = 50
+const maxParallelBlockDownloads = 4
+
+func (n *Node) sync(ctx context.Context) {
+	ticker := time.NewTicker(n.syncEvery)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			fmt.Println("Searching for new Peers and Blocks.....")
-			n.doSync()
+			n.logger.Debug("searching for new peers and blocks")
+			n.doSync(ctx)
 		case <-ctx.Done():
-			ticker.Stop()
+			return
 		}
 	}
 }
-func (n *Node) doSync() {
-	for _, peer := range n.knownPeers {
-		fmt.Println("im peer", peer.Port)
+func (n *Node) doSync(ctx context.Context) {
+	for _, peer := range n.getKnownPeers() {
+		if ctx.Err() != nil {
+			return
+		}
 		if n.Info.IP == peer.IP && n.Info.Port == peer.Port {
 			continue
 		}
 
-		fmt.Printf("Searching for new Peers and their Blocks and Peers: '%s'\n", peer.TcpAddress())
+		n.logger.Debug("syncing with peer", "peer", peer.TcpAddress())
 
-		status, err := queryPeerStatus(peer)
-		fmt.Println(status)
+		status, err := n.queryPeerStatus(peer)
 		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
-			fmt.Printf("Peer '%s' was removed from KnownPeers\n", peer.TcpAddress())
+			n.logger.Warn("peer is unreachable", "peer", peer.TcpAddress(), "err", err)
+			syncFailures.Inc(peer.TcpAddress())
 
 			n.RemovePeer(peer)
 
 			continue
 		}
+		n.progress.observePeer(peer, status.Number)
 		err = n.joinKnownPeers(peer)
 		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
+			n.logger.Error("joining peer failed", "peer", peer.TcpAddress(), "err", err)
+			syncFailures.Inc(peer.TcpAddress())
 			continue
 		}
-		err = n.syncBlocks(peer, status)
+		err = n.syncBlocks(ctx, peer, status)
 		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
+			n.logger.Error("syncing blocks failed", "peer", peer.TcpAddress(), "err", err)
+			syncFailures.Inc(peer.TcpAddress())
 			continue
 		}
 		err = n.syncKnownPeers(status)
 		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
+			n.logger.Error("syncing peers failed", "peer", peer.TcpAddress(), "err", err)
+			syncFailures.Inc(peer.TcpAddress())
 			continue
 		}
 		err = n.syncPendingTXs(peer, status.PendingTXs)
 		if err != nil {
-			fmt.Printf("Error:%s\n", err)
+			n.logger.Error("syncing pending TXs failed", "peer", peer.TcpAddress(), "err", err)
+			syncFailures.Inc(peer.TcpAddress())
 			continue
 
 		}
 	}
 }
-func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
+func (n *Node) syncBlocks(ctx context.Context, peer PeerNode, status StatusRes) error {
+	// The chain only changes through this sync until it's done.
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+
 	localBlockNumber := n.state.LatestBlock().Header.Number
 	if status.Hash.IsEmpty() {
 		return nil
@@ -70,36 +88,278 @@ func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
 	if status.Number < localBlockNumber {
 		return nil
 	}
-	if status.Number == 0 && !n.state.LatestBlockHash().IsEmpty() {
+	if status.Number == localBlockNumber && !n.state.LatestBlockHash().IsEmpty() {
 		return nil
 	}
-	newBlocksCount := status.Number - localBlockNumber
-	if localBlockNumber == 0 && status.Number == 0 {
-		newBlocksCount = 1
+
+	ancestor, headers, err := n.fetchHeaders(peer, status)
+	if err != nil {
+		return err
 	}
-	fmt.Printf("Found %d new blocks from Peer %s\n", newBlocksCount, peer.TcpAddress())
+	if len(headers) == 0 {
+		return nil
+	}
+
+	if ancestor != n.state.LatestBlockHash() {
+		if headers[len(headers)-1].Value.Number <= localBlockNumber {
+			return nil
+		}
+		return n.reorg(ctx, peer, ancestor, headers)
+	}
+
+	n.logger.Info("found new blocks", "peer", peer.TcpAddress(), "blocks", len(headers), "height", headers[len(headers)-1].Value.Number)
 
-	blocks, err := fetchBlocksFromPeer(peer, n.state.LatestBlockHash())
+	return n.downloadBlocks(ctx, peer, headers)
+}
+
+// fetchHeaders finds the last block shared with the peer using a block
+// locator and downloads, page by page, the headers of the peer's chain
+// following it. The headers are checked to form a valid chain on top of the
+// common ancestor before any block body is requested.
+func (n *Node) fetchHeaders(peer PeerNode, status StatusRes) (database.Hash, []database.BlockHeaderFS, error) {
+	locateRes, err := n.locateOnPeer(peer, n.state.BlockLocator(), syncHeadersPageSize)
 	if err != nil {
+		return database.Hash{}, nil, err
+	}
+
+	ancestor := locateRes.Ancestor
+	parentHash := ancestor
+	parent := database.BlockHeader{}
+	if ancestor == n.state.LatestBlockHash() {
+		parent = n.state.LatestBlock().Header
+	} else if !ancestor.IsEmpty() {
+		block, err := database.GetBlockByHash(ancestor, n.dataDir)
+		if err != nil {
+			return database.Hash{}, nil, err
+		}
+		parent = block.Header
+	}
+
+	engine := n.state.Engine()
+	headers := make([]database.BlockHeaderFS, 0)
+	page := locateRes.Headers
+	for len(page) > 0 {
+		for _, header := range page {
+			err := verifyHeaderLink(engine, parent, parentHash, header)
+			if err != nil {
+				return database.Hash{}, nil, fmt.Errorf("invalid header from Peer %s: %s", peer.TcpAddress(), err)
+			}
+			parent = header.Value
+			parentHash = header.Key
+		}
+		headers = append(headers, page...)
+		if parent.Number >= status.Number {
+			break
+		}
+
+		page, err = n.fetchHeadersFromPeer(peer, parentHash, syncHeadersPageSize)
+		if errors.Is(err, database.ErrBlockNotFound) {
+			return database.Hash{}, nil, fmt.Errorf("Peer %s switched to another branch during the sync: %w", peer.TcpAddress(), err)
+		}
+		if err != nil {
+			return database.Hash{}, nil, err
+		}
+	}
+	return ancestor, headers, nil
+}
+
+// reorg switches the local chain to the peer's longer fork: the local
+// blocks after the common ancestor are rolled back, the peer's blocks are
+// imported and the TXs of the orphaned blocks go back to the pending pool.
+// If the import fails, the orphaned blocks are restored. Mining is paused
+// meanwhile, so no block is sealed on top of the ancestor.
+func (n *Node) reorg(ctx context.Context, peer PeerNode, ancestor database.Hash, headers []database.BlockHeaderFS) error {
+	resume := n.pauseMining()
+	defer resume()
+	n.logger.Info("peer is on a longer fork, rolling back local blocks", "peer", peer.TcpAddress(), "ancestor", ancestor.Hex())
+
+	orphaned, err := n.state.RollbackTo(ancestor)
+	if err != nil {
+		return err
+	}
+	n.logger.Info("rolled back orphaned blocks", "blocks", len(orphaned))
+	n.returnOrphanedTXs(orphaned)
+
+	err = n.downloadBlocks(ctx, peer, headers)
+	if err != nil {
+		n.logger.Error("importing the fork failed, restoring orphaned blocks", "peer", peer.TcpAddress(), "blocks", len(orphaned), "err", err)
+		_, rollbackErr := n.state.RollbackTo(ancestor)
+		if rollbackErr != nil {
+			return rollbackErr
+		}
+		for _, block := range orphaned {
+			hash, restoreErr := n.state.AddBlock(block)
+			if restoreErr != nil {
+				return restoreErr
+			}
+			n.removeMinedPendingTXs(block)
+			n.publishBlock(block, hash)
+		}
 		return err
 	}
+
+	orphanedHashes := make([]database.Hash, 0, len(orphaned))
+	for _, block := range orphaned {
+		hash, err := block.Hash()
+		if err == nil {
+			orphanedHashes = append(orphanedHashes, hash)
+		}
+	}
+	reorgs.Inc()
+	n.events.publish(EventReorg, ReorgEvent{ancestor, orphanedHashes, n.state.LatestBlockHash()})
+	return nil
+}
+
+// returnOrphanedTXs puts the TXs of blocks dropped from the chain back into
+// the pending pool. TXs included again by the new chain get archived as its
+// blocks are imported.
+func (n *Node) returnOrphanedTXs(blocks []database.Block) {
 	for _, block := range blocks {
-		_, err = n.state.AddBlock(block)
-		if err != nil {
+		for _, tx := range block.Txs {
+			if tx.IsCoinbase() {
+				continue
+			}
+			txHash, err := tx.Hash()
+			if err != nil {
+				continue
+			}
+			n.txsMu.Lock()
+			delete(n.archivedTXs, txHash.Hex())
+			n.pendingTXs[txHash.Hex()] = tx
+			mempoolSize.Set(float64(len(n.pendingTXs)))
+			n.txsMu.Unlock()
+			n.events.publish(EventPendingTx, BlockTxRes{txHash, tx}, tx.From, tx.To)
+		}
+	}
+}
+
+func verifyHeaderLink(engine database.ConsensusEngine, parent database.BlockHeader, parentHash database.Hash, header database.BlockHeaderFS) error {
+	if parentHash.IsEmpty() {
+		if !header.Value.Parent.IsEmpty() {
+			return fmt.Errorf("first block must not have a parent, got '%x'", header.Value.Parent)
+		}
+	} else {
+		if header.Value.Parent != parentHash {
+			return fmt.Errorf("block %d parent hash must be '%x' not '%x'", header.Value.Number, parentHash, header.Value.Parent)
+		}
+		if header.Value.Number != parent.Number+1 {
+			return fmt.Errorf("next expected block must '%d' not '%d'", parent.Number+1, header.Value.Number)
+		}
+	}
+	return engine.VerifyHeader(parent, header.Value, header.Key)
+}
+
+// blockPage is a range of consecutive blocks requested in one /node/sync call.
+type blockPage struct {
+	from    database.Hash
+	headers []database.BlockHeaderFS
+}
+
+// downloadBlocks fetches the bodies of the given headers in pages of
+// syncBlocksPageSize. Each round requests one page from each of up to
+// maxParallelBlockDownloads peers at once, then imports them in order. It
+// stops between rounds once ctx is cancelled.
+func (n *Node) downloadBlocks(ctx context.Context, origin PeerNode, headers []database.BlockHeaderFS) error {
+	n.progress.startImport(n.state.LatestBlock().Header.Number, time.Now())
+	defer func() {
+		n.progress.finishImport(n.state.LatestBlock().Header.Number, time.Now())
+	}()
+	sources := n.blockSources(origin)
+	from := n.state.LatestBlockHash()
+
+	for len(headers) > 0 {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		round := make([]blockPage, 0, len(sources))
+		for len(round) < len(sources) && len(headers) > 0 {
+			size := syncBlocksPageSize
+			if size > len(headers) {
+				size = len(headers)
+			}
+			round = append(round, blockPage{from, headers[:size]})
+			from = headers[size-1].Key
+			headers = headers[size:]
+		}
+
+		results := make([][]database.Block, len(round))
+		errs := make([]error, len(round))
+		var wg sync.WaitGroup
+		for i, page := range round {
+			wg.Add(1)
+			go func(i int, page blockPage, source PeerNode) {
+				defer wg.Done()
+				results[i], errs[i] = n.fetchBlockPage(source, page)
+				if errs[i] != nil && source.TcpAddress() != origin.TcpAddress() {
+					// A peer without the blocks simply isn't on the same branch.
+					if !errors.Is(errs[i], database.ErrBlockNotFound) {
+						n.logger.Warn("downloading blocks failed, retrying from origin", "peer", source.TcpAddress(), "origin", origin.TcpAddress(), "err", errs[i])
+						syncFailures.Inc(source.TcpAddress())
+					}
+					results[i], errs[i] = n.fetchBlockPage(origin, page)
+				}
+			}(i, page, sources[i])
+		}
+		wg.Wait()
 
-		n.newSyncedBlocks <- block
+		for i := range round {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			for _, block := range results[i] {
+				hash, err := n.state.AddBlock(block)
+				if err != nil {
+					return err
+				}
+				n.removeMinedPendingTXs(block)
+				n.publishBlock(block, hash)
+			}
+		}
 	}
 
 	return nil
 }
 
+// blockSources lists the peers block pages are downloaded from, origin first.
+func (n *Node) blockSources(origin PeerNode) []PeerNode {
+	sources := []PeerNode{origin}
+	for _, peer := range n.getKnownPeers() {
+		if len(sources) == maxParallelBlockDownloads {
+			break
+		}
+		if peer.TcpAddress() == origin.TcpAddress() || peer.TcpAddress() == n.Info.TcpAddress() {
+			continue
+		}
+		sources = append(sources, peer)
+	}
+	return sources
+}
+
+// fetchBlockPage downloads the blocks of page and checks they match the
+// already validated headers.
+func (n *Node) fetchBlockPage(peer PeerNode, page blockPage) ([]database.Block, error) {
+	blocks, err := n.fetchBlocksFromPeer(peer, page.from, len(page.headers))
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) != len(page.headers) {
+		return nil, fmt.Errorf("Peer %s returned %d blocks instead of %d", peer.TcpAddress(), len(blocks), len(page.headers))
+	}
+	for i, block := range blocks {
+		hash, err := block.Hash()
+		if err != nil {
+			return nil, err
+		}
+		if hash != page.headers[i].Key {
+			return nil, fmt.Errorf("Peer %s returned block '%s' instead of '%s'", peer.TcpAddress(), hash.Hex(), page.headers[i].Key.Hex())
+		}
+	}
+	return blocks, nil
+}
+
 func (n *Node) syncKnownPeers(status StatusRes) error {
 	for _, statusPeer := range status.KnownPeers {
 		if !n.IsKnownPeer(statusPeer) {
-			fmt.Printf("Found new Peer %s\n", statusPeer.TcpAddress())
-
 			n.AddPeer(statusPeer)
 		}
 	}
@@ -109,6 +369,12 @@ func (n *Node) syncKnownPeers(status StatusRes) error {
 func (n *Node) syncPendingTXs(peer PeerNode, txs []database.Tx) error {
 	for _, tx := range txs {
 		err := n.AddPendingTX(tx, peer)
+		// A TX already known, or one the local balances can't pay for, must
+		// not keep the TXs following it out of the pool.
+		if errors.Is(err, ErrConflict) || errors.Is(err, database.ErrInsufficientBalance) || errors.Is(err, database.ErrInvalidTx) {
+			n.logger.Debug("skipped TX of peer", "peer", peer.TcpAddress(), "err", err)
+			continue
+		}
 		if err != nil {
 			return err
 		}
@@ -122,34 +388,19 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 		return nil
 	}
 
-	url := fmt.Sprintf(
-		"http://%s%s?%s=%s&%s=%d",
-		peer.TcpAddress(),
-		endpointAddPeer,
-		endpointAddPeerQueryKeyIP,
-		n.Info.IP,
-		endpointAddPeerQueryKeyPort,
-		n.Info.Port,
-	)
-
-	res, err := http.Get(url)
-	if err != nil {
-		return err
-	}
+	query := url.Values{}
+	query.Set(endpointAddPeerQueryKeyIP, n.Info.IP)
+	query.Set(endpointAddPeerQueryKeyPort, strconv.FormatUint(n.Info.Port, 10))
 
 	addPeerRes := AddPeerRes{}
-	err = readRes(res, &addPeerRes)
+	err := n.client.getJson(n.client.peerURL(peer, endpointAddPeer, query), &addPeerRes)
 	if err != nil {
 		return err
 	}
-	if addPeerRes.Error != "" {
-		return fmt.Errorf(addPeerRes.Error)
-	}
 
-	knownPeer := n.knownPeers[peer.TcpAddress()]
-	knownPeer.connected = addPeerRes.Success
+	peer.connected = addPeerRes.Success
 
-	n.AddPeer(knownPeer)
+	n.AddPeer(peer)
 
 	if !addPeerRes.Success {
 		return fmt.Errorf("unable to join KnownPeers of '%s'", peer.TcpAddress())
@@ -158,44 +409,49 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 	return nil
 }
 
-func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash) ([]database.Block, error) {
-	fmt.Printf("Importing blocks from Peer %s...\n", peer.TcpAddress())
-
-	url := fmt.Sprintf(
-		"http://%s%s?%s=%s",
-		peer.TcpAddress(),
-		endpointSync,
-		endpointSyncQueryKeyFromBlock,
-		fromBlock.Hex(),
-	)
+func (n *Node) fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash, limit int) ([]database.Block, error) {
+	n.logger.Debug("importing blocks", "peer", peer.TcpAddress(), "from", fromBlock.Hex())
 
-	res, err := http.Get(url)
+	syncRes := SyncRes{}
+	err := n.client.getJson(n.client.peerURL(peer, endpointSync, syncQuery(fromBlock, limit)), &syncRes)
 	if err != nil {
 		return nil, err
 	}
 
-	syncRes := SyncRes{}
-	err = readRes(res, &syncRes)
+	return syncRes.Blocks, nil
+}
+
+func (n *Node) fetchHeadersFromPeer(peer PeerNode, fromBlock database.Hash, limit int) ([]database.BlockHeaderFS, error) {
+	headersRes := HeadersRes{}
+	err := n.client.getJson(n.client.peerURL(peer, endpointHeaders, syncQuery(fromBlock, limit)), &headersRes)
 	if err != nil {
 		return nil, err
 	}
 
-	return syncRes.Blocks, nil
+	return headersRes.Headers, nil
 }
 
-func queryPeerStatus(peer PeerNode) (StatusRes, error) {
-	url := fmt.Sprintf("http://%s%s", peer.TcpAddress(), endpointStatus)
-	fmt.Println(url)
-	res, err := http.Get(url)
-	fmt.Println(err)
+func syncQuery(fromBlock database.Hash, limit int) url.Values {
+	query := url.Values{}
+	query.Set(endpointSyncQueryKeyFromBlock, fromBlock.Hex())
+	query.Set(endpointSyncQueryKeyLimit, strconv.Itoa(limit))
+	return query
+}
+
+func (n *Node) locateOnPeer(peer PeerNode, locator []database.Hash, limit int) (LocateRes, error) {
+	locateRes := LocateRes{}
+	err := n.client.postJson(n.client.peerURL(peer, endpointLocate, nil), LocateReq{locator, limit}, &locateRes)
 	if err != nil {
-		return StatusRes{}, err
+		return LocateRes{}, err
 	}
+	return locateRes, nil
+}
+
+func (n *Node) queryPeerStatus(peer PeerNode) (StatusRes, error) {
 	statusRes := StatusRes{}
-	err = readRes(res, &statusRes)
-	fmt.Println(statusRes)
+	err := n.client.getJson(n.client.peerURL(peer, endpointStatus, nil), &statusRes)
 	if err != nil {
-		return StatusRes{}, nil
+		return StatusRes{}, err
 	}
 	return statusRes, nil
 }
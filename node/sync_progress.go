@@ -0,0 +1,94 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// syncProgress tracks the chain heights reported by peers during syncs and
+// how fast blocks are being imported, for the health and progress
+// endpoints.
+type syncProgress struct {
+	mu          sync.Mutex
+	peerHeights map[string]uint64
+	syncing     bool
+	startHeight uint64
+	startTime   time.Time
+	lastRate    float64
+}
+
+func newSyncProgress() *syncProgress {
+	return &syncProgress{peerHeights: make(map[string]uint64)}
+}
+
+func (p *syncProgress) observePeer(peer PeerNode, height uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peerHeights[peer.TcpAddress()] = height
+}
+
+func (p *syncProgress) forgetPeer(peer PeerNode) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.peerHeights, peer.TcpAddress())
+}
+
+// peers returns how many peers answered during the syncs.
+func (p *syncProgress) peers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.peerHeights)
+}
+
+// bestPeer returns the peer reporting the highest chain, if any.
+func (p *syncProgress) bestPeer() (string, uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var bestPeer string
+	var bestHeight uint64
+	for peer, height := range p.peerHeights {
+		if bestPeer == "" || height > bestHeight {
+			bestPeer, bestHeight = peer, height
+		}
+	}
+	return bestPeer, bestHeight, bestPeer != ""
+}
+
+// startImport marks the beginning of a block download from height.
+func (p *syncProgress) startImport(height uint64, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncing = true
+	p.startHeight = height
+	p.startTime = now
+}
+
+// finishImport ends the download, keeping its rate as the last known one.
+func (p *syncProgress) finishImport(height uint64, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.syncing {
+		return
+	}
+	p.lastRate = importRate(p.startHeight, height, p.startTime, now)
+	p.syncing = false
+}
+
+// rate returns the blocks per second of the running download, or of the
+// last one when none is running.
+func (p *syncProgress) rate(height uint64, now time.Time) (float64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.syncing {
+		return importRate(p.startHeight, height, p.startTime, now), true
+	}
+	return p.lastRate, false
+}
+
+func importRate(fromHeight uint64, toHeight uint64, from time.Time, to time.Time) float64 {
+	elapsed := to.Sub(from).Seconds()
+	if toHeight <= fromHeight || elapsed <= 0 {
+		return 0
+	}
+	return float64(toHeight-fromHeight) / elapsed
+}
@@ -0,0 +1,257 @@
+package node
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TLSConfig holds the PEM files securing the API. With CertFile and KeyFile
+// the node serves HTTPS and talks HTTPS to its peers. CAFile additionally
+// turns on mutual TLS: clients must present a certificate signed by the CA,
+// and peers must serve one, so only nodes holding such a certificate can
+// join the network.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// ClientConfig is how clients such as the remote miner reach a node.
+type ClientConfig struct {
+	APIToken string
+	TLS      TLSConfig
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+func (c TLSConfig) serverConfig() (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("serving TLS requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the TLS certificate '%s': %w", c.CertFile, err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		config.ClientCAs, err = loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// clientConfig trusts the CA, when set, instead of the system roots and
+// presents the certificate, when set, to servers requiring mutual TLS.
+func (c TLSConfig) clientConfig() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the TLS certificate '%s': %w", c.CertFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		roots, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = roots
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caPem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("no PEM certificate found in CA file '%s'", caFile)
+	}
+	return pool, nil
+}
+
+// WithTLS serves the API over TLS and secures the calls to peers, see
+// TLSConfig.
+func WithTLS(config TLSConfig) Option {
+	return func(n *Node) {
+		n.tls = config
+	}
+}
+
+const (
+	CAName         = "ca"
+	certFileSuffix = ".crt"
+	keyFileSuffix  = ".key"
+	caValidity     = 10 * 365 * 24 * time.Hour
+	certValidity   = 2 * 365 * 24 * time.Hour
+)
+
+// GenerateCerts writes a certificate and key per name to dir, named
+// <name>.crt and <name>.key, signed by the local CA in ca.crt and ca.key.
+// The CA is created on first use and reused afterwards, so certificates for
+// new nodes can be added to an existing network. hosts are the IPs and DNS
+// names the nodes are reached at. Certificates are valid both as server and
+// as client certificates, as nodes are both to each other.
+func GenerateCerts(dir string, names []string, hosts []string) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, err := loadOrCreateCA(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if name == CAName {
+			return fmt.Errorf("'%s' is reserved for the CA", CAName)
+		}
+		err = generateNodeCert(dir, name, hosts, caCert, caKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, CAName+certFileSuffix)
+	keyPath := filepath.Join(dir, CAName+keyFileSuffix)
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil {
+		caCert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		caKey, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("CA key '%s' isn't an ECDSA key", keyPath)
+		}
+		return caCert, caKey, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := newCertTemplate("TBB local CA", caValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writeCertAndKey(certPath, keyPath, der, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	slog.Info("wrote CA", "path", certPath)
+	return caCert, caKey, nil
+}
+
+func generateNodeCert(dir string, name string, hosts []string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := newCertTemplate(name, certValidity)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(dir, name+certFileSuffix)
+	err = writeCertAndKey(certPath, filepath.Join(dir, name+keyFileSuffix), der, key)
+	if err != nil {
+		return err
+	}
+	slog.Info("wrote certificate", "name", name, "path", certPath)
+	return nil
+}
+
+func newCertTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+// writeCertAndKey refuses to overwrite existing files, regenerating a key
+// by accident would lock its node out of the network.
+func writeCertAndKey(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = writePemFile(keyPath, "EC PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return err
+	}
+	return writePemFile(certPath, "CERTIFICATE", der, 0644)
+}
+
+func writePemFile(path string, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,106 @@
+package node
+
+import (
+	"blocks/database"
+	"fmt"
+)
+
+// getWork builds a block template out of the current pending TXs so an
+// external miner can search for the nonce. Templates are remembered by ID
+// until the chain tip moves on.
+func (n *Node) getWork(miner database.Account) (WorkRes, error) {
+	if n.state.Engine().Name() != database.ConsensusPoW {
+		return WorkRes{}, fmt.Errorf("%w: external mining requires '%s' consensus", ErrConflict, database.ConsensusPoW)
+	}
+	if miner == "" {
+		miner = n.Info.Account
+	}
+	txs := n.getPendingTXsAsArray()
+	if len(txs) == 0 {
+		return WorkRes{Target: database.BlockHashTargetPrefix}, nil
+	}
+	pb, err := n.newPendingBlock(miner, txs)
+	if err != nil {
+		return WorkRes{}, err
+	}
+	id, err := pb.id()
+	if err != nil {
+		return WorkRes{}, err
+	}
+
+	n.workMu.Lock()
+	n.pruneWork()
+	n.work[id.Hex()] = pb
+	n.workMu.Unlock()
+
+	return WorkRes{
+		ID:     id.Hex(),
+		Parent: pb.parent,
+		Number: pb.number,
+		Time:   pb.time,
+		Miner:  pb.miner,
+		Reward: pb.reward,
+		Txs:    pb.txs,
+		Target: database.BlockHashTargetPrefix,
+	}, nil
+}
+
+// submitWork rebuilds the block of a previously handed out template with the
+// solved nonce and imports it like any other block. Submissions are handled
+// one at a time, so a template is never imported twice.
+func (n *Node) submitWork(req SubmitWorkReq) (database.Hash, error) {
+	n.workMu.Lock()
+	defer n.workMu.Unlock()
+	pb, ok := n.work[req.ID]
+	if !ok {
+		return database.Hash{}, fmt.Errorf("%w: unknown or stale work '%s'", ErrNotFound, req.ID)
+	}
+	if req.Time < pb.time {
+		return database.Hash{}, fmt.Errorf("%w: block time '%d' is older than the work time '%d'", ErrBadRequest, req.Time, pb.time)
+	}
+
+	block := pb.block(req.Nonce, req.Time, pb.miner)
+	hash, err := block.Hash()
+	if err != nil {
+		return database.Hash{}, err
+	}
+	if !database.IsBlockHashValid(hash) {
+		return database.Hash{}, fmt.Errorf("%w: nonce '%d' does not solve work '%s'", ErrBadRequest, req.Nonce, req.ID)
+	}
+
+	// Checking the tip and adding the block happen under chainMu, like the
+	// blocks sealed by this node and synced from peers, so no other block
+	// takes the height in between.
+	n.chainMu.Lock()
+	defer n.chainMu.Unlock()
+	if pb.parent != n.state.LatestBlockHash() {
+		delete(n.work, req.ID)
+		return database.Hash{}, fmt.Errorf("%w: work '%s' is stale, the chain tip moved", ErrConflict, req.ID)
+	}
+	_, err = n.state.AddBlock(block)
+	if err != nil {
+		return database.Hash{}, err
+	}
+	delete(n.work, req.ID)
+	n.logger.Info("accepted block from external miner", "block", hash.Hex(), "height", block.Header.Number, "miner", pb.miner)
+
+	n.removeMinedPendingTXs(block)
+	n.publishBlock(block, hash)
+
+	return hash, nil
+}
+
+// pruneWork forgets templates built on top of a block that is no longer the
+// tip. It must be called with n.workMu held.
+func (n *Node) pruneWork() {
+	tip := n.state.LatestBlockHash()
+	for id, pb := range n.work {
+		if pb.parent != tip {
+			delete(n.work, id)
+		}
+	}
+}
+
+func (pb PendingBlock) id() (database.Hash, error) {
+	return pb.block(0, pb.time, pb.miner).Hash()
+}